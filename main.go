@@ -1,13 +1,27 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
 
+	"github.com/acorn-io/acorn-istio-plugin/pkg/analyze"
 	"github.com/acorn-io/acorn-istio-plugin/pkg/controller"
+	"github.com/acorn-io/acorn-istio-plugin/pkg/metrics"
+	"github.com/acorn-io/acorn-istio-plugin/pkg/migrate"
 	"github.com/acorn-io/acorn-istio-plugin/pkg/scheme"
+	"github.com/acorn-io/acorn-istio-plugin/pkg/self"
+	"github.com/acorn-io/acorn-istio-plugin/pkg/sidecar"
 	"github.com/acorn-io/acorn-istio-plugin/pkg/version"
+	"github.com/acorn-io/acorn-istio-plugin/pkg/webhook"
 	"k8s.io/client-go/kubernetes"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
 
 	"github.com/acorn-io/baaah/pkg/restconfig"
@@ -17,12 +31,53 @@ import (
 
 var (
 	versionFlag                = flag.Bool("version", false, "print version and exit")
-	debugImageFlag             = flag.String("debug-image", "ghcr.io/acorn-io/acorn-istio-plugin:main", "Container image used to kill Istio sidecars (needs to have curl installed)")
+	metricsAddressFlag         = flag.String("metrics-address", ":8080", "Address on which to serve Prometheus metrics (empty to disable)")
+	webhookAddressFlag         = flag.String("webhook-address", ":9443", "Address on which to serve admission webhooks (empty to disable)")
+	webhookServiceNameFlag     = flag.String("webhook-service-name", "istio-plugin-controller", "Name of the Service, in the plugin's namespace, through which the API server reaches the webhooks")
+	protectManagedResources    = flag.Bool("protect-managed-resources", false, "Reject changes to the Istio objects generated by the plugin, and namespace-wide PeerAuthentications in the namespaces of Acorn apps, unless they carry the break-glass annotation")
+	holdApplicationFlag        = flag.Bool("hold-application-until-proxy-starts", true, "Only start the containers of Acorn apps once their Istio proxy is ready, unless the app opts out")
+	debugImageFlag             = flag.String("debug-image", "", "Container image used to kill Istio sidecars (needs to have curl installed). Defaults to the plugin's own image, using the quit-sidecar subcommand")
+	sidecarShutdownDeadline    = flag.Duration("sidecar-shutdown-deadline", 5*time.Minute, "How long after an Acorn job finished to keep trying to shut down its Istio sidecar before emitting a Warning Event (0 to retry forever)")
+	deleteStuckJobPods         = flag.Bool("delete-stuck-job-pods", false, "Delete job pods whose Istio sidecar could not be shut down before the deadline, once their Job is complete")
+	proxyConcurrency           = flag.Int("proxy-concurrency", -1, "Default number of Envoy worker threads for Acorn apps, 0 meaning one per CPU core (negative to use the mesh default)")
+	proxyImageType             = flag.String("proxy-image-type", "", "Default Istio proxy image type for Acorn apps: default, debug, or distroless (empty to use the mesh default)")
+	proxyCPU                   = flag.String("proxy-cpu", "", "Default CPU request of the Istio proxy of Acorn apps (empty to use the mesh default)")
+	proxyCPULimit              = flag.String("proxy-cpu-limit", "", "Default CPU limit of the Istio proxy of Acorn apps (empty to use the mesh default)")
+	proxyMemory                = flag.String("proxy-memory", "", "Default memory request of the Istio proxy of Acorn apps (empty to use the mesh default)")
+	proxyMemoryLimit           = flag.String("proxy-memory-limit", "", "Default memory limit of the Istio proxy of Acorn apps (empty to use the mesh default)")
+	scopeSidecarEgress         = flag.Bool("scope-sidecar-egress", false, "Limit the configuration of the Istio proxies of Acorn apps to their own namespace, the namespaces of their links, istio-system, and --sidecar-egress-namespaces")
+	sidecarEgressNamespaces    = flag.String("sidecar-egress-namespaces", "", "Extra namespaces whose services the Istio proxies of all Acorn apps can reach when --scope-sidecar-egress is enabled (comma-separated)")
+	externalLinkTLSOrigination = flag.Bool("external-link-tls-origination", false, "Upgrade the plaintext HTTP traffic of Acorn links to hosts outside the cluster to TLS on port 443")
+	egressLockdown             = flag.Bool("egress-lockdown", false, "Only allow Acorn apps to reach external hosts that are registered in the mesh, unless the app opts out")
+	egressHintInterval         = flag.Duration("egress-hint-interval", time.Minute, "How often the Istio proxies of locked down apps are checked for blocked connections (0 to disable)")
+	clusterDomain              = flag.String("cluster-domain", "cluster.local", "DNS domain of the cluster, used to recognize the hostnames of Services")
+	includeProjects            = flag.String("include-projects", "", "Acorn projects to enroll in the mesh, as a label selector or comma-separated name globs (empty for all)")
+	excludeProjects            = flag.String("exclude-projects", "", "Acorn projects to leave out of the mesh, as a label selector or comma-separated name globs")
+	orphanSweepInterval        = flag.Duration("orphan-sweep-interval", 10*time.Minute, "How often managed objects are checked for a missing owner (0 to only check when they change)")
 	allowTrafficFromNamespaces = flag.String("allow-traffic-from-namespaces", "", `Extra namespaces that should be allowed to send traffic to all Acorn apps (comma-separated).
 								Pods in these namespaces must be part of the Istio service mesh in order to send traffic.`)
+	localTrafficSourceCIDRs = flag.String("local-traffic-source-cidrs", "", `CIDRs allowed to send plaintext traffic to published ports of Services with externalTrafficPolicy: Local (comma-separated).
+								Only used for Services that don't set loadBalancerSourceRanges. If empty, plaintext traffic is allowed from anywhere.`)
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "quit-sidecar":
+			quitSidecar(os.Args[2:])
+			return
+		case "explain":
+			explain(os.Args[2:])
+			return
+		case "reachability":
+			reachability(os.Args[2:])
+			return
+		case "uninstall":
+			uninstall(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Parse()
 
 	logrus.SetLevel(logrus.ErrorLevel)
@@ -43,13 +98,261 @@ func main() {
 	k8s := kubernetes.NewForConfigOrDie(config)
 
 	ctx := signals.SetupSignalHandler()
+	metrics.Serve(ctx, *metricsAddressFlag)
+
+	if err := serveWebhooks(ctx, k8s); err != nil {
+		logrus.Fatal(err)
+	}
+
+	if err := runMigrations(ctx); err != nil {
+		logrus.Fatal(err)
+	}
+
 	if err := controller.Start(ctx, controller.Options{
 		K8s:                        k8s,
 		DebugImage:                 *debugImageFlag,
 		AllowTrafficFromNamespaces: *allowTrafficFromNamespaces,
+		LocalTrafficSourceCIDRs:    *localTrafficSourceCIDRs,
+		OrphanSweepInterval:        *orphanSweepInterval,
+		SidecarShutdownDeadline:    *sidecarShutdownDeadline,
+		DeleteStuckJobPods:         *deleteStuckJobPods,
+		ProxyConcurrency:           *proxyConcurrency,
+		ProxyImageType:             *proxyImageType,
+		ScopeSidecarEgress:         *scopeSidecarEgress,
+		SidecarEgressNamespaces:    *sidecarEgressNamespaces,
+		ExternalLinkTLSOrigination: *externalLinkTLSOrigination,
+		EgressLockdown:             *egressLockdown,
+		EgressHintInterval:         *egressHintInterval,
+		ClusterDomain:              *clusterDomain,
+		IncludeProjects:            *includeProjects,
+		ExcludeProjects:            *excludeProjects,
 	}); err != nil {
 		logrus.Fatal(err)
 	}
 	<-ctx.Done()
 	logrus.Fatal(ctx.Err())
 }
+
+// serveWebhooks serves the enabled admission webhooks, and unregisters them when they are all disabled
+func serveWebhooks(ctx context.Context, k8s kubernetes.Interface) error {
+	var webhooks []webhook.Webhook
+	if *holdApplicationFlag {
+		webhooks = append(webhooks, webhook.HoldApplicationUntilProxyStarts(k8s))
+	}
+	webhooks = append(webhooks, webhook.ProxyResources(k8s, map[string]string{
+		"acorn.io/istio-proxy-cpu":          *proxyCPU,
+		"acorn.io/istio-proxy-cpu-limit":    *proxyCPULimit,
+		"acorn.io/istio-proxy-memory":       *proxyMemory,
+		"acorn.io/istio-proxy-memory-limit": *proxyMemoryLimit,
+	}))
+	if *protectManagedResources {
+		username, err := self.Username()
+		if err != nil {
+			return err
+		}
+		webhooks = append(webhooks, webhook.ProtectManagedResources(username), webhook.ProtectAppPeerAuthentications(username))
+	}
+	if *webhookAddressFlag == "" || len(webhooks) == 0 {
+		return webhook.Serve(ctx, webhook.Options{K8s: k8s})
+	}
+
+	namespace, err := self.Namespace()
+	if err != nil {
+		return err
+	}
+
+	return webhook.Serve(ctx, webhook.Options{
+		K8s:         k8s,
+		Address:     *webhookAddressFlag,
+		Namespace:   namespace,
+		ServiceName: *webhookServiceNameFlag,
+		Port:        webhookPort(*webhookAddressFlag),
+	}, webhooks...)
+}
+
+// runMigrations upgrades the objects left by earlier versions of the plugin, before the controller starts
+func runMigrations(ctx context.Context) error {
+	namespace, err := self.Namespace()
+	if err != nil {
+		return err
+	}
+	config, err := restconfig.Default()
+	if err != nil {
+		return err
+	}
+	c, err := kclient.New(config, kclient.Options{Scheme: scheme.Scheme})
+	if err != nil {
+		return err
+	}
+	return migrate.Run(ctx, c, namespace, controller.Migrations)
+}
+
+// webhookPort returns the port of the webhook address, which the Service is expected to expose as is
+func webhookPort(address string) int32 {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return 443
+	}
+	n, err := strconv.ParseInt(port, 10, 32)
+	if err != nil {
+		return 443
+	}
+	return int32(n)
+}
+
+// quitSidecar runs in an ephemeral container of a finished job pod, and asks its Istio proxy to shut down
+func quitSidecar(args []string) {
+	flags := flag.NewFlagSet("quit-sidecar", flag.ExitOnError)
+	timeout := flags.Duration("timeout", time.Minute, "How long to keep trying to shut down the Istio proxy")
+	retryInterval := flags.Duration("retry-interval", 2*time.Second, "How long to wait between attempts")
+	_ = flags.Parse(args)
+
+	if err := sidecar.Quit(context.Background(), sidecar.QuitOptions{
+		RetryInterval: *retryInterval,
+		Timeout:       *timeout,
+	}); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+// explain prints the effective mesh posture of an app namespace, from the cluster or from a YAML snapshot
+func explain(args []string) {
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s explain [flags] <namespace>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	snapshotFile := flags.String("f", "", "YAML snapshot of the cluster to read instead of the cluster, such as the output of kubectl get -A -o yaml (- for stdin)")
+	output := flags.String("o", "text", "Output format: text or json")
+	rootNamespace := flags.String("root-namespace", analyze.DefaultRootNamespace, "Istio root namespace")
+	clusterDomain := flags.String("cluster-domain", "cluster.local", "DNS domain of the cluster, used to recognize the hostnames of Services")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	namespace := flags.Arg(0)
+
+	snapshot, err := loadSnapshot(context.Background(), *snapshotFile, namespace)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	explanation := analyze.Explain(snapshot, namespace, analyze.Options{
+		RootNamespace: *rootNamespace,
+		ClusterDomain: *clusterDomain,
+	})
+
+	switch *output {
+	case "json":
+		err = writeJSON(os.Stdout, explanation)
+	case "text":
+		err = explanation.WriteText(os.Stdout)
+	default:
+		err = fmt.Errorf("unknown output format %q", *output)
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+// reachability prints which apps and namespaces can reach which ports of the Acorn apps, from the cluster or from a
+// YAML snapshot
+func reachability(args []string) {
+	flags := flag.NewFlagSet("reachability", flag.ExitOnError)
+	snapshotFile := flags.String("f", "", "YAML snapshot of the cluster to read instead of the cluster, such as the output of kubectl get -A -o yaml (- for stdin)")
+	output := flags.String("o", "json", "Output format: json or dot")
+	rootNamespace := flags.String("root-namespace", analyze.DefaultRootNamespace, "Istio root namespace")
+	clusterDomain := flags.String("cluster-domain", "cluster.local", "DNS domain of the cluster, used to recognize the hostnames of Services")
+	_ = flags.Parse(args)
+
+	snapshot, err := loadSnapshot(context.Background(), *snapshotFile)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	result := analyze.Reach(snapshot, analyze.Options{
+		RootNamespace: *rootNamespace,
+		ClusterDomain: *clusterDomain,
+	})
+
+	switch *output {
+	case "json":
+		err = writeJSON(os.Stdout, result)
+	case "dot":
+		err = result.WriteDOT(os.Stdout)
+	default:
+		err = fmt.Errorf("unknown output format %q", *output)
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+// uninstall reverts the changes that the plugin made to the cluster, and prints them
+func uninstall(args []string) {
+	flags := flag.NewFlagSet("uninstall", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Only print what would be removed")
+	_ = flags.Parse(args)
+
+	ctx := context.Background()
+	config, err := restconfig.Default()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	c, err := kclient.New(config, kclient.Options{Scheme: scheme.Scheme})
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	// The webhooks go first, so that they don't protect the objects being deleted
+	if *dryRun {
+		fmt.Println("would remove the admission webhook configurations")
+	} else {
+		if err := webhook.Unregister(ctx, kubernetes.NewForConfigOrDie(config)); err != nil {
+			logrus.Fatal(err)
+		}
+		fmt.Println("removed the admission webhook configurations")
+	}
+
+	changes, err := controller.Uninstall(ctx, c, *dryRun)
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if *dryRun {
+		fmt.Println("dry run, nothing was removed")
+	}
+}
+
+// loadSnapshot reads a snapshot from the file, or from the cluster if the file is empty. Pods are only read from the
+// cluster in the given namespaces, or in all of them if there are none.
+func loadSnapshot(ctx context.Context, file string, podNamespaces ...string) (*analyze.Snapshot, error) {
+	switch file {
+	case "":
+		config, err := restconfig.Default()
+		if err != nil {
+			return nil, err
+		}
+		c, err := kclient.New(config, kclient.Options{Scheme: scheme.Scheme})
+		if err != nil {
+			return nil, err
+		}
+		return analyze.FromCluster(ctx, c, podNamespaces...)
+	case "-":
+		return analyze.FromYAML(os.Stdin)
+	default:
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return analyze.FromYAML(f)
+	}
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
@@ -0,0 +1,275 @@
+package analyze
+
+import (
+	"strconv"
+	"strings"
+
+	"istio.io/api/security/v1beta1"
+	securityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// match is the result of matching a request against an AuthorizationPolicy. The attributes of a request that aren't
+// known statically, such as the client IP or the HTTP path, make a rule match maybe.
+type match int
+
+const (
+	noMatch match = iota
+	maybeMatch
+	fullMatch
+)
+
+// allOf combines conditions that must all match
+func allOf(matches ...match) match {
+	result := fullMatch
+	for _, m := range matches {
+		if m < result {
+			result = m
+		}
+	}
+	return result
+}
+
+// anyOf combines conditions of which one must match
+func anyOf(matches ...match) match {
+	result := noMatch
+	for _, m := range matches {
+		if m > result {
+			result = m
+		}
+	}
+	return result
+}
+
+// peer is the client of a request
+type peer struct {
+	// namespace is only known for clients in the mesh, which present their identity with mTLS
+	namespace string
+	mtls      bool
+}
+
+// authorization is the result of evaluating the AuthorizationPolicies of a workload for a request
+type authorization struct {
+	allowed bool
+	// conditional is true when the decision depends on attributes of the request that aren't known statically
+	conditional bool
+	// policy is the namespace/name of the policy that denied the request, or that conditionally allowed or denied it
+	policy string
+}
+
+// authorize evaluates the AuthorizationPolicies that apply to pods with the given labels like Istio does: a request
+// matching a DENY policy is denied, and otherwise it is allowed if there are no ALLOW policies or if it matches one.
+// CUSTOM and AUDIT policies are ignored.
+func (s *Snapshot) authorize(rootNamespace, namespace string, podLabels map[string]string, from peer, port uint32) authorization {
+	var allowPolicies, denyPolicies []*securityv1beta1.AuthorizationPolicy
+	for _, ap := range s.AuthorizationPolicies {
+		if ap.Namespace != namespace && ap.Namespace != rootNamespace {
+			continue
+		}
+		if ap.Spec.Selector != nil && len(ap.Spec.Selector.MatchLabels) > 0 &&
+			!labels.SelectorFromSet(ap.Spec.Selector.MatchLabels).Matches(labels.Set(podLabels)) {
+			continue
+		}
+		switch ap.Spec.Action {
+		case v1beta1.AuthorizationPolicy_ALLOW:
+			allowPolicies = append(allowPolicies, ap)
+		case v1beta1.AuthorizationPolicy_DENY:
+			denyPolicies = append(denyPolicies, ap)
+		}
+	}
+
+	result := authorization{allowed: true}
+	for _, ap := range denyPolicies {
+		switch policyMatch(ap, from, port) {
+		case fullMatch:
+			return authorization{policy: objectKey(ap.Namespace, ap.Name)}
+		case maybeMatch:
+			result.conditional = true
+			result.policy = objectKey(ap.Namespace, ap.Name)
+		}
+	}
+	if len(allowPolicies) == 0 {
+		return result
+	}
+
+	allowed, allowPolicy := noMatch, ""
+	for _, ap := range allowPolicies {
+		if m := policyMatch(ap, from, port); m > allowed {
+			allowed, allowPolicy = m, objectKey(ap.Namespace, ap.Name)
+		}
+	}
+	switch allowed {
+	case noMatch:
+		return authorization{}
+	case maybeMatch:
+		result.conditional = true
+	}
+	if result.policy == "" {
+		result.policy = allowPolicy
+	}
+	return result
+}
+
+func policyMatch(ap *securityv1beta1.AuthorizationPolicy, from peer, port uint32) match {
+	result := noMatch
+	for _, rule := range ap.Spec.Rules {
+		result = anyOf(result, ruleMatch(rule, from, port))
+	}
+	return result
+}
+
+func ruleMatch(rule *v1beta1.Rule, from peer, port uint32) match {
+	if rule == nil {
+		return fullMatch
+	}
+
+	fromMatch := fullMatch
+	if len(rule.From) > 0 {
+		fromMatch = noMatch
+		for _, f := range rule.From {
+			if f.Source == nil {
+				fromMatch = fullMatch
+				continue
+			}
+			fromMatch = anyOf(fromMatch, sourceMatch(f.Source, from))
+		}
+	}
+
+	toMatch := fullMatch
+	if len(rule.To) > 0 {
+		toMatch = noMatch
+		for _, t := range rule.To {
+			if t.Operation == nil {
+				toMatch = fullMatch
+				continue
+			}
+			toMatch = anyOf(toMatch, operationMatch(t.Operation, port))
+		}
+	}
+
+	whenMatch := fullMatch
+	if len(rule.When) > 0 {
+		whenMatch = maybeMatch
+	}
+	return allOf(fromMatch, toMatch, whenMatch)
+}
+
+func sourceMatch(source *v1beta1.Source, from peer) match {
+	var matches []match
+
+	if len(source.Principals) > 0 {
+		matches = append(matches, principalsMatch(source.Principals, from))
+	}
+	if len(source.NotPrincipals) > 0 {
+		matches = append(matches, not(principalsMatch(source.NotPrincipals, from)))
+	}
+	if len(source.Namespaces) > 0 {
+		matches = append(matches, namespacesMatch(source.Namespaces, from))
+	}
+	if len(source.NotNamespaces) > 0 {
+		matches = append(matches, not(namespacesMatch(source.NotNamespaces, from)))
+	}
+	// The client IP and the JWT of requests aren't known statically
+	if len(source.RequestPrincipals) > 0 || len(source.NotRequestPrincipals) > 0 ||
+		len(source.IpBlocks) > 0 || len(source.NotIpBlocks) > 0 ||
+		len(source.RemoteIpBlocks) > 0 || len(source.NotRemoteIpBlocks) > 0 {
+		matches = append(matches, maybeMatch)
+	}
+	return allOf(matches...)
+}
+
+// principalsMatch matches the identity of the peer, which is cluster.local/ns/<namespace>/sa/<service account>. The
+// service account of the peer isn't known, so a principal of a specific service account only matches maybe.
+func principalsMatch(principals []string, from peer) match {
+	if !from.mtls {
+		return noMatch
+	}
+
+	result := noMatch
+	for _, principal := range principals {
+		switch {
+		case principal == "*":
+			return fullMatch
+		case strings.HasSuffix(principal, "*") &&
+			strings.HasPrefix("cluster.local/ns/"+from.namespace+"/sa/", strings.TrimSuffix(principal, "*")):
+			// Every service account of the namespace
+			result = anyOf(result, fullMatch)
+		case strings.Contains(principal, "/ns/"+from.namespace+"/"), strings.HasPrefix(principal, "*"),
+			strings.HasSuffix(principal, "*"):
+			result = anyOf(result, maybeMatch)
+		}
+	}
+	return result
+}
+
+func namespacesMatch(namespaces []string, from peer) match {
+	if !from.mtls {
+		return noMatch
+	}
+	for _, namespace := range namespaces {
+		if stringMatch(namespace, from.namespace) {
+			return fullMatch
+		}
+	}
+	return noMatch
+}
+
+func operationMatch(operation *v1beta1.Operation, port uint32) match {
+	var matches []match
+
+	p := strconv.Itoa(int(port))
+	if len(operation.Ports) > 0 {
+		matches = append(matches, boolMatch(contains(operation.Ports, p)))
+	}
+	if len(operation.NotPorts) > 0 {
+		matches = append(matches, boolMatch(!contains(operation.NotPorts, p)))
+	}
+	// The HTTP attributes of requests aren't known statically
+	if len(operation.Hosts) > 0 || len(operation.NotHosts) > 0 || len(operation.Methods) > 0 ||
+		len(operation.NotMethods) > 0 || len(operation.Paths) > 0 || len(operation.NotPaths) > 0 {
+		matches = append(matches, maybeMatch)
+	}
+	return allOf(matches...)
+}
+
+func not(m match) match {
+	switch m {
+	case fullMatch:
+		return noMatch
+	case noMatch:
+		return fullMatch
+	default:
+		return maybeMatch
+	}
+}
+
+func boolMatch(b bool) match {
+	if b {
+		return fullMatch
+	}
+	return noMatch
+}
+
+// stringMatch matches a value against an Istio string pattern: an exact value, a prefix ending with *, or a suffix
+// starting with *
+func stringMatch(pattern, value string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasSuffix(pattern, "*"):
+		return strings.HasPrefix(value, strings.TrimSuffix(pattern, "*"))
+	case strings.HasPrefix(pattern, "*"):
+		return strings.HasSuffix(value, strings.TrimPrefix(pattern, "*"))
+	default:
+		return pattern == value
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
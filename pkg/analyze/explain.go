@@ -0,0 +1,349 @@
+package analyze
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/hostname"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	acornContainerNameLabel   = "acorn.io/container-name"
+	acornJobNameLabel         = "acorn.io/job-name"
+	acornLinkNameLabel        = "acorn.io/link-name"
+	proxySidecarContainerName = "istio-proxy"
+)
+
+// Options configure the analysis
+type Options struct {
+	// RootNamespace is the Istio root namespace, DefaultRootNamespace if empty
+	RootNamespace string
+	// ClusterDomain is the DNS domain of the cluster, used to follow the ExternalNames of links
+	ClusterDomain string
+}
+
+func (o Options) rootNamespace() string {
+	if o.RootNamespace == "" {
+		return DefaultRootNamespace
+	}
+	return o.RootNamespace
+}
+
+// Explanation is the effective mesh posture of an app namespace
+type Explanation struct {
+	Namespace string `json:"namespace"`
+	// MTLS is the mode of the ports that no workload policy covers
+	MTLS PortMTLS `json:"mtls"`
+	// IgnoredPolicies are namespace-wide PeerAuthentications that Istio ignores, because they aren't the oldest one
+	IgnoredPolicies []string   `json:"ignoredPolicies,omitempty"`
+	Workloads       []Workload `json:"workloads"`
+	Links           []Link     `json:"links"`
+}
+
+// Workload is a group of pods running the same Acorn container or job
+type Workload struct {
+	Name string `json:"name"`
+	// Policy is the PeerAuthentication that Istio applies to the pods, if any selects them
+	Policy string `json:"policy,omitempty"`
+	// IgnoredPolicies are the other PeerAuthentications that select the pods, which Istio ignores
+	IgnoredPolicies []string `json:"ignoredPolicies,omitempty"`
+	Pods            []Pod    `json:"pods"`
+	Ports           []Port   `json:"ports"`
+}
+
+// Pod is a pod of a workload and the state of its Istio sidecar
+type Pod struct {
+	Name    string `json:"name"`
+	Sidecar string `json:"sidecar"`
+}
+
+// Port is a port of a workload with its effective mTLS mode
+type Port struct {
+	Port uint32 `json:"port"`
+	PortMTLS
+	// PublishedBy are the Ingresses and Services that caused the plugin to make the port PERMISSIVE. A port that is
+	// published but not PERMISSIVE is usually overridden by an older PeerAuthentication.
+	PublishedBy []Source `json:"publishedBy,omitempty"`
+}
+
+// Link is an Acorn link from the namespace and the VirtualService that routes it
+type Link struct {
+	Name           string `json:"name"`
+	VirtualService string `json:"virtualService,omitempty"`
+	Destination    string `json:"destination,omitempty"`
+	Status         string `json:"status"`
+}
+
+// Explain computes the effective mesh posture of the namespace
+func Explain(s *Snapshot, namespace string, opts Options) *Explanation {
+	resolver := hostname.NewResolver(opts.ClusterDomain)
+	namespacePolicies := s.policiesFor(opts.rootNamespace(), namespace, nil)
+
+	result := &Explanation{
+		Namespace: namespace,
+		MTLS:      namespacePolicies.mode(0),
+		Workloads: []Workload{},
+		Links:     s.links(namespace),
+	}
+	for _, pa := range s.PeerAuthentications {
+		if pa.Namespace == namespace && !hasSelector(pa) && pa != namespacePolicies.namespace {
+			result.IgnoredPolicies = append(result.IgnoredPolicies, objectKey(pa.Namespace, pa.Name))
+		}
+	}
+
+	for _, pods := range s.workloads(namespace) {
+		policies := s.policiesFor(opts.rootNamespace(), namespace, pods[0].Labels)
+
+		workload := Workload{
+			Name: workloadName(pods[0]),
+		}
+		if policies.workload != nil {
+			workload.Policy = objectKey(policies.workload.Namespace, policies.workload.Name)
+		}
+		for _, pa := range policies.ignored {
+			workload.IgnoredPolicies = append(workload.IgnoredPolicies, objectKey(pa.Namespace, pa.Name))
+		}
+		for _, pod := range pods {
+			workload.Pods = append(workload.Pods, Pod{
+				Name:    pod.Name,
+				Sidecar: sidecarState(pod),
+			})
+		}
+		for _, port := range workloadPorts(pods[0], policies) {
+			workload.Ports = append(workload.Ports, Port{
+				Port:        port,
+				PortMTLS:    policies.mode(port),
+				PublishedBy: s.portSources(resolver, namespace, pods[0].Labels, port),
+			})
+		}
+		result.Workloads = append(result.Workloads, workload)
+	}
+	return result
+}
+
+// workloads groups the pods of the namespace by workload, sorted by name
+func (s *Snapshot) workloads(namespace string) [][]*corev1.Pod {
+	byName := map[string][]*corev1.Pod{}
+	for _, pod := range s.Pods {
+		if pod.Namespace == namespace {
+			byName[workloadName(pod)] = append(byName[workloadName(pod)], pod)
+		}
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make([][]*corev1.Pod, 0, len(names))
+	for _, name := range names {
+		pods := byName[name]
+		sort.Slice(pods, func(i, j int) bool {
+			return pods[i].Name < pods[j].Name
+		})
+		result = append(result, pods)
+	}
+	return result
+}
+
+func workloadName(pod *corev1.Pod) string {
+	if name := pod.Labels[acornContainerNameLabel]; name != "" {
+		return name
+	}
+	if name := pod.Labels[acornJobNameLabel]; name != "" {
+		return name
+	}
+	return pod.Name
+}
+
+// workloadPorts returns the TCP ports of the containers of the pod, along with the ports that have a port level
+// setting in its policy
+func workloadPorts(pod *corev1.Pod, policies appliedPolicies) []uint32 {
+	ports := map[uint32]bool{}
+	for _, container := range pod.Spec.Containers {
+		if container.Name == proxySidecarContainerName {
+			continue
+		}
+		for _, port := range container.Ports {
+			if port.Protocol == corev1.ProtocolTCP || port.Protocol == "" {
+				ports[uint32(port.ContainerPort)] = true
+			}
+		}
+	}
+	for _, port := range policies.ports() {
+		ports[port] = true
+	}
+
+	result := make([]uint32, 0, len(ports))
+	for port := range ports {
+		result = append(result, port)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i] < result[j]
+	})
+	return result
+}
+
+// sidecarState describes the Istio sidecar of the pod, which is either a regular container or, with native sidecars,
+// an init container
+func sidecarState(pod *corev1.Pod) string {
+	if !hasSidecarContainer(pod.Spec.Containers) && !hasSidecarContainer(pod.Spec.InitContainers) {
+		return "none"
+	}
+
+	var statuses []corev1.ContainerStatus
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	statuses = append(statuses, pod.Status.InitContainerStatuses...)
+	for _, status := range statuses {
+		if status.Name != proxySidecarContainerName {
+			continue
+		}
+		switch {
+		case status.State.Running != nil && status.Ready:
+			return "ready"
+		case status.State.Running != nil:
+			return "not ready"
+		case status.State.Terminated != nil:
+			return "terminated"
+		}
+	}
+	return "waiting"
+}
+
+func hasSidecarContainer(containers []corev1.Container) bool {
+	for _, container := range containers {
+		if container.Name == proxySidecarContainerName {
+			return true
+		}
+	}
+	return false
+}
+
+// links returns the links of the namespace, from both the link Services and the managed VirtualServices, so that
+// missing and leftover VirtualServices show up
+func (s *Snapshot) links(namespace string) []Link {
+	byName := map[string]*Link{}
+	for _, service := range s.Services {
+		if service.Namespace == namespace && service.Labels[acornLinkNameLabel] != "" {
+			byName[service.Name] = &Link{
+				Name:   service.Name,
+				Status: "missing VirtualService",
+			}
+		}
+	}
+
+	for _, vs := range s.VirtualServices {
+		if vs.Namespace != namespace || !isManaged(vs.Labels) {
+			continue
+		}
+
+		var destinations []string
+		for _, route := range vs.Spec.Http {
+			for _, destination := range route.Route {
+				if destination.Destination == nil {
+					continue
+				}
+				d := destination.Destination.Host
+				if destination.Destination.Port != nil {
+					d = fmt.Sprintf("%s:%d", d, destination.Destination.Port.Number)
+				}
+				destinations = append(destinations, d)
+			}
+		}
+
+		link := byName[vs.Name]
+		if link == nil {
+			link = &Link{
+				Name:   vs.Name,
+				Status: "stale: the link Service is gone",
+			}
+			byName[vs.Name] = link
+		} else {
+			link.Status = "active"
+		}
+		link.VirtualService = objectKey(vs.Namespace, vs.Name)
+		link.Destination = strings.Join(destinations, ", ")
+	}
+
+	result := make([]Link, 0, len(byName))
+	for _, link := range byName {
+		result = append(result, *link)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// WriteText writes the explanation in a human readable form
+func (e *Explanation) WriteText(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Namespace %s\n", e.Namespace)
+	fmt.Fprintf(w, "  Default mTLS: %s\n", describeMTLS(e.MTLS))
+	for _, policy := range e.IgnoredPolicies {
+		fmt.Fprintf(w, "  Ignored: %s (not the oldest namespace-wide PeerAuthentication)\n", policy)
+	}
+
+	for _, workload := range e.Workloads {
+		fmt.Fprintf(w, "\nWorkload %s\n", workload.Name)
+		if workload.Policy != "" {
+			fmt.Fprintf(w, "  Policy: %s\n", workload.Policy)
+		}
+		for _, policy := range workload.IgnoredPolicies {
+			fmt.Fprintf(w, "  Ignored: %s (not the oldest PeerAuthentication selecting these pods)\n", policy)
+		}
+		fmt.Fprintf(w, "  POD\tSIDECAR\n")
+		for _, pod := range workload.Pods {
+			fmt.Fprintf(w, "  %s\t%s\n", pod.Name, pod.Sidecar)
+		}
+		if len(workload.Ports) > 0 {
+			fmt.Fprintf(w, "  PORT\tMTLS\tDECIDED BY\tPUBLISHED BY\n")
+		}
+		for _, port := range workload.Ports {
+			sources := make([]string, 0, len(port.PublishedBy))
+			for _, source := range port.PublishedBy {
+				sources = append(sources, source.String())
+			}
+			fmt.Fprintf(w, "  %d\t%s\t%s\t%s\n", port.Port, port.Mode, describePolicy(port.PortMTLS), orNone(strings.Join(sources, ", ")))
+		}
+	}
+
+	fmt.Fprintf(w, "\nLinks\n")
+	if len(e.Links) == 0 {
+		fmt.Fprintf(w, "  none\n")
+	} else {
+		fmt.Fprintf(w, "  NAME\tDESTINATION\tSTATUS\n")
+	}
+	for _, link := range e.Links {
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", link.Name, orNone(link.Destination), link.Status)
+	}
+	return w.Flush()
+}
+
+func describeMTLS(m PortMTLS) string {
+	return m.Mode + " (" + describePolicy(m) + ")"
+}
+
+func describePolicy(m PortMTLS) string {
+	switch {
+	case m.Policy == "":
+		return "Istio default"
+	case m.PortLevel:
+		return m.Policy + " port level"
+	default:
+		return m.Policy
+	}
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
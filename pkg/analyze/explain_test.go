@@ -0,0 +1,40 @@
+package analyze
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readSnapshot(t *testing.T, path string) *Snapshot {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	snapshot, err := FromYAML(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
+
+func TestExplain(t *testing.T) {
+	snapshot := readSnapshot(t, "testdata/explain/snapshot.yaml")
+
+	out := &bytes.Buffer{}
+	if err := Explain(snapshot, "my-app-namespace", Options{}).WriteText(out); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := os.ReadFile("testdata/explain/expected.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(expected), out.String())
+}
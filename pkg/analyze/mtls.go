@@ -0,0 +1,118 @@
+package analyze
+
+import (
+	"sort"
+
+	"istio.io/api/security/v1beta1"
+	securityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// PortMTLS is the effective mTLS mode of a port, and the PeerAuthentication that decided it
+type PortMTLS struct {
+	Mode string `json:"mode"`
+	// Policy is the namespace/name of the PeerAuthentication, or empty when the Istio default applies
+	Policy string `json:"policy,omitempty"`
+	// PortLevel is true when the mode comes from the portLevelMtls of the policy
+	PortLevel bool `json:"portLevel,omitempty"`
+}
+
+// appliedPolicies are the PeerAuthentications that apply to the pods of a workload
+type appliedPolicies struct {
+	mesh      *securityv1beta1.PeerAuthentication
+	namespace *securityv1beta1.PeerAuthentication
+	workload  *securityv1beta1.PeerAuthentication
+	// ignored are the other PeerAuthentications that select the pods. Istio only applies the oldest one.
+	ignored []*securityv1beta1.PeerAuthentication
+}
+
+// policiesFor returns the PeerAuthentications that apply to pods with the given labels
+func (s *Snapshot) policiesFor(rootNamespace, namespace string, podLabels map[string]string) appliedPolicies {
+	var meshWide, namespaceWide, selecting []*securityv1beta1.PeerAuthentication
+	for _, pa := range s.PeerAuthentications {
+		switch {
+		case !hasSelector(pa) && pa.Namespace == rootNamespace:
+			meshWide = append(meshWide, pa)
+		case pa.Namespace != namespace:
+		case !hasSelector(pa):
+			namespaceWide = append(namespaceWide, pa)
+		case labels.SelectorFromSet(pa.Spec.Selector.MatchLabels).Matches(labels.Set(podLabels)):
+			selecting = append(selecting, pa)
+		}
+	}
+
+	result := appliedPolicies{
+		mesh:      oldest(meshWide),
+		namespace: oldest(namespaceWide),
+		workload:  oldest(selecting),
+	}
+	for _, pa := range selecting {
+		if pa != result.workload {
+			result.ignored = append(result.ignored, pa)
+		}
+	}
+	return result
+}
+
+// mode returns the effective mTLS mode of the port. A port level setting of the workload policy wins, then the
+// first policy that sets a mode, from the most specific to the mesh-wide one. Istio defaults to PERMISSIVE.
+func (p appliedPolicies) mode(port uint32) PortMTLS {
+	if p.workload != nil {
+		if portMTLS := p.workload.Spec.PortLevelMtls[port]; portMTLS != nil && portMTLS.Mode != v1beta1.PeerAuthentication_MutualTLS_UNSET {
+			return PortMTLS{
+				Mode:      portMTLS.Mode.String(),
+				Policy:    objectKey(p.workload.Namespace, p.workload.Name),
+				PortLevel: true,
+			}
+		}
+	}
+
+	for _, pa := range []*securityv1beta1.PeerAuthentication{p.workload, p.namespace, p.mesh} {
+		if pa != nil && pa.Spec.Mtls != nil && pa.Spec.Mtls.Mode != v1beta1.PeerAuthentication_MutualTLS_UNSET {
+			return PortMTLS{
+				Mode:   pa.Spec.Mtls.Mode.String(),
+				Policy: objectKey(pa.Namespace, pa.Name),
+			}
+		}
+	}
+	return PortMTLS{Mode: v1beta1.PeerAuthentication_MutualTLS_PERMISSIVE.String()}
+}
+
+// ports returns the ports that have a port level setting in the workload policy
+func (p appliedPolicies) ports() []uint32 {
+	if p.workload == nil {
+		return nil
+	}
+	result := make([]uint32, 0, len(p.workload.Spec.PortLevelMtls))
+	for port := range p.workload.Spec.PortLevelMtls {
+		result = append(result, port)
+	}
+	return result
+}
+
+func hasSelector(pa *securityv1beta1.PeerAuthentication) bool {
+	return pa.Spec.Selector != nil && len(pa.Spec.Selector.MatchLabels) > 0
+}
+
+// oldest returns the PeerAuthentication that Istio applies when several of them match: the oldest one, with the
+// name as the tiebreaker
+func oldest(pas []*securityv1beta1.PeerAuthentication) *securityv1beta1.PeerAuthentication {
+	if len(pas) == 0 {
+		return nil
+	}
+	sorted := append([]*securityv1beta1.PeerAuthentication(nil), pas...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].CreationTimestamp.Equal(&sorted[j].CreationTimestamp) {
+			return sorted[i].CreationTimestamp.Before(&sorted[j].CreationTimestamp)
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted[0]
+}
+
+func objectKey(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
@@ -0,0 +1,300 @@
+package analyze
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/hostname"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	acornAppNameLabel     = "acorn.io/app-name"
+	acornProjectNameLabel = "acorn.io/app-namespace"
+	acornProjectLabel     = "acorn.io/project"
+	injectionLabel        = "istio-injection"
+
+	// OutsideMesh is the name of the peer that stands for every client without an Istio sidecar, such as ingress
+	// controllers, load balancers, and pods outside the mesh
+	OutsideMesh = "outside the mesh"
+
+	TransportMTLS      = "mtls"
+	TransportPlaintext = "plaintext"
+)
+
+// Reachability is the matrix of which apps and namespaces can reach which ports of the Acorn apps
+type Reachability struct {
+	Peers   []Peer   `json:"peers"`
+	Targets []Target `json:"targets"`
+	// Paths has an entry for every peer and target, whether the target is reachable or not
+	Paths []Path `json:"paths"`
+}
+
+// Peer is a client of the Acorn apps: an app, a project namespace, or every client outside the mesh
+type Peer struct {
+	Name string `json:"name"`
+	// Kind is app, project, or external
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	// Mesh is true when the pods of the peer have Istio sidecars, which authenticate them with mTLS
+	Mesh bool `json:"mesh"`
+}
+
+// Target is a port of a workload of an Acorn app
+type Target struct {
+	// ID is <namespace>/<workload>:<port>
+	ID        string   `json:"id"`
+	App       string   `json:"app"`
+	Namespace string   `json:"namespace"`
+	Workload  string   `json:"workload"`
+	Port      uint32   `json:"port"`
+	MTLS      PortMTLS `json:"mtls"`
+	// Sidecar is true when every pod of the workload has an Istio sidecar that is running or about to start. Without
+	// one, neither the mTLS mode nor the AuthorizationPolicies are enforced.
+	Sidecar     bool     `json:"sidecar"`
+	PublishedBy []Source `json:"publishedBy,omitempty"`
+}
+
+// Path is whether a peer can reach a target, and how
+type Path struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Transport is mtls or plaintext, and is only set when the target is reachable
+	Transport string `json:"transport,omitempty"`
+	Reachable bool   `json:"reachable"`
+	// Conditional is true when an AuthorizationPolicy decides based on attributes of the requests that aren't known
+	// statically, such as the client IP or the HTTP path
+	Conditional bool `json:"conditional,omitempty"`
+	// Linked is true when the peer has an Acorn link to the namespace of the target
+	Linked bool `json:"linked,omitempty"`
+	// Reason explains why the target isn't reachable, or which policy it depends on
+	Reason string `json:"reason,omitempty"`
+}
+
+// Reach computes which apps and namespaces can reach which ports of the Acorn apps, from the mTLS mode of the ports
+// and the AuthorizationPolicies of the workloads
+func Reach(s *Snapshot, opts Options) *Reachability {
+	resolver := hostname.NewResolver(opts.ClusterDomain)
+	result := &Reachability{
+		Peers:   []Peer{},
+		Targets: []Target{},
+		Paths:   []Path{},
+	}
+
+	namespaces := append([]*corev1.Namespace(nil), s.Namespaces...)
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].Name < namespaces[j].Name
+	})
+
+	// Keep the labels of the pods of each target, to match the policies
+	targetLabels := map[string]map[string]string{}
+	for _, ns := range namespaces {
+		switch {
+		case ns.Labels[acornProjectNameLabel] != "":
+			result.Peers = append(result.Peers, Peer{
+				Name:      appName(ns),
+				Kind:      "app",
+				Namespace: ns.Name,
+				Mesh:      inMesh(ns),
+			})
+		case ns.Labels[acornProjectLabel] == "true":
+			result.Peers = append(result.Peers, Peer{
+				Name:      "project " + ns.Name,
+				Kind:      "project",
+				Namespace: ns.Name,
+				Mesh:      inMesh(ns),
+			})
+			continue
+		default:
+			continue
+		}
+
+		for _, pods := range s.workloads(ns.Name) {
+			policies := s.policiesFor(opts.rootNamespace(), ns.Name, pods[0].Labels)
+			for _, port := range workloadPorts(pods[0], policies) {
+				target := Target{
+					ID:          fmt.Sprintf("%s/%s:%d", ns.Name, workloadName(pods[0]), port),
+					App:         appName(ns),
+					Namespace:   ns.Name,
+					Workload:    workloadName(pods[0]),
+					Port:        port,
+					MTLS:        policies.mode(port),
+					Sidecar:     sidecarsEnforced(pods),
+					PublishedBy: s.portSources(resolver, ns.Name, pods[0].Labels, port),
+				}
+				targetLabels[target.ID] = pods[0].Labels
+				result.Targets = append(result.Targets, target)
+			}
+		}
+	}
+	result.Peers = append(result.Peers, Peer{
+		Name: OutsideMesh,
+		Kind: "external",
+	})
+
+	links := s.linkedNamespaces(resolver)
+	for _, p := range result.Peers {
+		for _, target := range result.Targets {
+			path := s.reach(opts.rootNamespace(), p, target, targetLabels[target.ID])
+			path.Linked = p.Namespace != "" && links[p.Namespace][target.Namespace]
+			result.Paths = append(result.Paths, path)
+		}
+	}
+	return result
+}
+
+func (s *Snapshot) reach(rootNamespace string, from Peer, target Target, podLabels map[string]string) Path {
+	path := Path{
+		From: from.Name,
+		To:   target.ID,
+	}
+
+	switch {
+	case !target.Sidecar:
+		// Nothing enforces the policies, any client can send plaintext to the pods without a sidecar
+		path.Transport = TransportPlaintext
+		path.Reachable = true
+		path.Reason = "no running Istio sidecar, mTLS and AuthorizationPolicies aren't enforced"
+		return path
+	case target.MTLS.Mode == "DISABLE":
+		path.Transport = TransportPlaintext
+	case from.Mesh:
+		path.Transport = TransportMTLS
+	case target.MTLS.Mode == "STRICT":
+		path.Reason = "STRICT mTLS (" + describePolicy(target.MTLS) + ")"
+		return path
+	default:
+		path.Transport = TransportPlaintext
+	}
+
+	// Without mTLS, the policies don't know which namespace the request comes from
+	authz := s.authorize(rootNamespace, target.Namespace, podLabels, peer{
+		namespace: from.Namespace,
+		mtls:      path.Transport == TransportMTLS,
+	}, target.Port)
+	switch {
+	case !authz.allowed && authz.policy != "":
+		path.Transport = ""
+		path.Reason = "denied by AuthorizationPolicy " + authz.policy
+	case !authz.allowed:
+		path.Transport = ""
+		path.Reason = "not allowed by any AuthorizationPolicy"
+	case authz.conditional:
+		path.Reachable = true
+		path.Conditional = true
+		path.Reason = "depends on the requests, see AuthorizationPolicy " + authz.policy
+	default:
+		path.Reachable = true
+	}
+	return path
+}
+
+// sidecarsEnforced returns false if a pod of the workload has no Istio sidecar, or a sidecar that was shut down, such as
+// the pods of completed jobs
+func sidecarsEnforced(pods []*corev1.Pod) bool {
+	for _, pod := range pods {
+		switch sidecarState(pod) {
+		case "none", "terminated":
+			return false
+		}
+	}
+	return true
+}
+
+// linkedNamespaces returns, for every namespace, the namespaces of the Services that its links point to
+func (s *Snapshot) linkedNamespaces(resolver hostname.Resolver) map[string]map[string]bool {
+	result := map[string]map[string]bool{}
+	for _, service := range s.Services {
+		if service.Labels[acornLinkNameLabel] == "" || service.Spec.Type != corev1.ServiceTypeExternalName {
+			continue
+		}
+		target := resolver.Resolve(service.Spec.ExternalName)
+		if target.Kind != hostname.ClusterService {
+			continue
+		}
+		if result[service.Namespace] == nil {
+			result[service.Namespace] = map[string]bool{}
+		}
+		result[service.Namespace][target.Namespace] = true
+	}
+	return result
+}
+
+// appName returns <project>/<app> for app namespaces
+func appName(ns *corev1.Namespace) string {
+	if ns.Labels[acornAppNameLabel] == "" {
+		return ns.Name
+	}
+	return ns.Labels[acornProjectNameLabel] + "/" + ns.Labels[acornAppNameLabel]
+}
+
+func inMesh(ns *corev1.Namespace) bool {
+	return ns.Labels[injectionLabel] == "enabled" || ns.Labels["istio.io/rev"] != ""
+}
+
+// WriteDOT writes the reachable paths as a Graphviz graph. Targets are grouped by app, plaintext paths are red, and
+// conditional paths are dashed.
+func (r *Reachability) WriteDOT(w io.Writer) error {
+	var b strings.Builder
+
+	b.WriteString("digraph reachability {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box];\n")
+	for _, p := range r.Peers {
+		shape := "box"
+		if p.Kind == "external" {
+			shape = "ellipse"
+		}
+		fmt.Fprintf(&b, "  %s [label=%s, shape=%s];\n", quote("peer:"+p.Name), quote(p.Name), shape)
+	}
+
+	var apps []string
+	targetsByApp := map[string][]Target{}
+	for _, target := range r.Targets {
+		if targetsByApp[target.App] == nil {
+			apps = append(apps, target.App)
+		}
+		targetsByApp[target.App] = append(targetsByApp[target.App], target)
+	}
+	for i, app := range apps {
+		fmt.Fprintf(&b, "  subgraph cluster_%d {\n", i)
+		fmt.Fprintf(&b, "    label=%s;\n", quote(app))
+		for _, target := range targetsByApp[app] {
+			mode := target.MTLS.Mode
+			if !target.Sidecar {
+				mode = "no sidecar"
+			}
+			fmt.Fprintf(&b, "    %s [label=%s];\n", quote(target.ID),
+				quote(fmt.Sprintf("%s:%d\n%s", target.Workload, target.Port, mode)))
+		}
+		b.WriteString("  }\n")
+	}
+
+	for _, path := range r.Paths {
+		if !path.Reachable {
+			continue
+		}
+		attrs := []string{"label=" + quote(path.Transport)}
+		if path.Transport == TransportPlaintext {
+			attrs = append(attrs, "color=red")
+		}
+		if path.Conditional {
+			attrs = append(attrs, "style=dashed")
+		}
+		if path.Linked {
+			attrs = append(attrs, "penwidth=2")
+		}
+		fmt.Fprintf(&b, "  %s -> %s [%s];\n", quote("peer:"+path.From), quote(path.To), strings.Join(attrs, ", "))
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// quote returns a Graphviz ID
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
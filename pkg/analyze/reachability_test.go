@@ -0,0 +1,136 @@
+package analyze
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"istio.io/api/security/v1beta1"
+	securityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReach(t *testing.T) {
+	result := Reach(readSnapshot(t, "testdata/reachability/snapshot.yaml"), Options{})
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := os.ReadFile("testdata/reachability/expected.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(t, string(expected), string(data))
+
+	dot := &bytes.Buffer{}
+	if err := result.WriteDOT(dot); err != nil {
+		t.Fatal(err)
+	}
+	expected, err = os.ReadFile("testdata/reachability/expected.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(expected), dot.String())
+}
+
+func TestAuthorize(t *testing.T) {
+	allowFromNamespace := &securityv1beta1.AuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "allow", Namespace: "api"},
+		Spec: v1beta1.AuthorizationPolicy{
+			Rules: []*v1beta1.Rule{{
+				From: []*v1beta1.Rule_From{{
+					Source: &v1beta1.Source{Namespaces: []string{"web-*"}},
+				}},
+			}, {
+				From: []*v1beta1.Rule_From{{
+					Source: &v1beta1.Source{Principals: []string{"cluster.local/ns/jobs/sa/cron"}},
+				}},
+			}},
+		},
+	}
+	denyPaths := &securityv1beta1.AuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "deny-admin", Namespace: "api"},
+		Spec: v1beta1.AuthorizationPolicy{
+			Action: v1beta1.AuthorizationPolicy_DENY,
+			Rules: []*v1beta1.Rule{{
+				To: []*v1beta1.Rule_To{{
+					Operation: &v1beta1.Operation{Ports: []string{"9000"}, Paths: []string{"/admin*"}},
+				}},
+			}},
+		},
+	}
+	denyAll := &securityv1beta1.AuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "deny-all", Namespace: "istio-system"},
+		Spec: v1beta1.AuthorizationPolicy{
+			Action: v1beta1.AuthorizationPolicy_DENY,
+			Rules:  []*v1beta1.Rule{{}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		policies []*securityv1beta1.AuthorizationPolicy
+		from     peer
+		port     uint32
+		expected authorization
+	}{
+		{
+			name:     "no policies",
+			from:     peer{},
+			port:     80,
+			expected: authorization{allowed: true},
+		},
+		{
+			name:     "allowed namespace",
+			policies: []*securityv1beta1.AuthorizationPolicy{allowFromNamespace},
+			from:     peer{namespace: "web-frontend", mtls: true},
+			port:     80,
+			expected: authorization{allowed: true, policy: "api/allow"},
+		},
+		{
+			name:     "namespace is unknown without mTLS",
+			policies: []*securityv1beta1.AuthorizationPolicy{allowFromNamespace},
+			from:     peer{namespace: "web-frontend"},
+			port:     80,
+			expected: authorization{},
+		},
+		{
+			name:     "service account of the peer is unknown",
+			policies: []*securityv1beta1.AuthorizationPolicy{allowFromNamespace},
+			from:     peer{namespace: "jobs", mtls: true},
+			port:     80,
+			expected: authorization{allowed: true, conditional: true, policy: "api/allow"},
+		},
+		{
+			name:     "path is unknown",
+			policies: []*securityv1beta1.AuthorizationPolicy{allowFromNamespace, denyPaths},
+			from:     peer{namespace: "web-frontend", mtls: true},
+			port:     9000,
+			expected: authorization{allowed: true, conditional: true, policy: "api/deny-admin"},
+		},
+		{
+			name:     "other port",
+			policies: []*securityv1beta1.AuthorizationPolicy{denyPaths},
+			from:     peer{namespace: "web-frontend", mtls: true},
+			port:     8080,
+			expected: authorization{allowed: true},
+		},
+		{
+			name:     "mesh-wide policy of the root namespace",
+			policies: []*securityv1beta1.AuthorizationPolicy{allowFromNamespace, denyAll},
+			from:     peer{namespace: "web-frontend", mtls: true},
+			port:     80,
+			expected: authorization{policy: "istio-system/deny-all"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Snapshot{AuthorizationPolicies: tt.policies}
+			assert.Equal(t, tt.expected, s.authorize(DefaultRootNamespace, "api", nil, tt.from, tt.port))
+		})
+	}
+}
@@ -0,0 +1,156 @@
+// Package analyze computes the effective mesh posture of Acorn apps from the objects in a cluster, or in a YAML
+// snapshot of one, without changing anything.
+package analyze
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/scheme"
+	networkingv1beta1 "istio.io/client-go/pkg/apis/networking/v1beta1"
+	securityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DefaultRootNamespace is the Istio root namespace, whose PeerAuthentications without a selector apply to the mesh
+const DefaultRootNamespace = "istio-system"
+
+// Snapshot holds the objects that the analysis looks at
+type Snapshot struct {
+	Namespaces            []*corev1.Namespace
+	Pods                  []*corev1.Pod
+	Services              []*corev1.Service
+	Ingresses             []*netv1.Ingress
+	PeerAuthentications   []*securityv1beta1.PeerAuthentication
+	AuthorizationPolicies []*securityv1beta1.AuthorizationPolicy
+	VirtualServices       []*networkingv1beta1.VirtualService
+}
+
+// FromCluster reads a snapshot from the cluster. Pods are only read in the given namespaces, or in all of them if
+// there are none, since they are by far the most numerous objects.
+func FromCluster(ctx context.Context, c kclient.Reader, podNamespaces ...string) (*Snapshot, error) {
+	s := &Snapshot{}
+
+	lists := []kclient.ObjectList{
+		&corev1.NamespaceList{},
+		&corev1.ServiceList{},
+		&netv1.IngressList{},
+		&securityv1beta1.PeerAuthenticationList{},
+		&securityv1beta1.AuthorizationPolicyList{},
+		&networkingv1beta1.VirtualServiceList{},
+	}
+	for _, list := range lists {
+		if err := c.List(ctx, list); err != nil {
+			return nil, err
+		}
+		if err := s.addList(list); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(podNamespaces) == 0 {
+		podNamespaces = []string{""}
+	}
+	for _, namespace := range podNamespaces {
+		pods := &corev1.PodList{}
+		if err := c.List(ctx, pods, kclient.InNamespace(namespace)); err != nil {
+			return nil, err
+		}
+		if err := s.addList(pods); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// FromYAML reads a snapshot from a stream of YAML or JSON documents, such as the output of kubectl get -o yaml.
+// Lists are flattened, and objects of other kinds are ignored.
+func FromYAML(r io.Reader) (*Snapshot, error) {
+	s := &Snapshot{}
+	decoder := scheme.Codecs.UniversalDeserializer()
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(r))
+
+	for {
+		doc, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return s, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		json, err := utilyaml.ToJSON(doc)
+		if err != nil {
+			return nil, err
+		}
+		if len(json) == 0 || string(json) == "null" {
+			continue
+		}
+
+		obj, _, err := decoder.Decode(json, nil, nil)
+		if runtime.IsNotRegisteredError(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to decode snapshot: %w", err)
+		}
+		if err := s.add(obj); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *Snapshot) add(obj runtime.Object) error {
+	switch o := obj.(type) {
+	case *corev1.List:
+		// Items of generic lists are left undecoded
+		decoder := scheme.Codecs.UniversalDeserializer()
+		for _, item := range o.Items {
+			itemObj, _, err := decoder.Decode(item.Raw, nil, nil)
+			if runtime.IsNotRegisteredError(err) {
+				continue
+			} else if err != nil {
+				return fmt.Errorf("failed to decode snapshot: %w", err)
+			}
+			if err := s.add(itemObj); err != nil {
+				return err
+			}
+		}
+	case kclient.ObjectList:
+		return s.addList(o)
+	case *corev1.Namespace:
+		s.Namespaces = append(s.Namespaces, o)
+	case *corev1.Pod:
+		s.Pods = append(s.Pods, o)
+	case *corev1.Service:
+		s.Services = append(s.Services, o)
+	case *netv1.Ingress:
+		s.Ingresses = append(s.Ingresses, o)
+	case *securityv1beta1.PeerAuthentication:
+		s.PeerAuthentications = append(s.PeerAuthentications, o)
+	case *securityv1beta1.AuthorizationPolicy:
+		s.AuthorizationPolicies = append(s.AuthorizationPolicies, o)
+	case *networkingv1beta1.VirtualService:
+		s.VirtualServices = append(s.VirtualServices, o)
+	}
+	return nil
+}
+
+func (s *Snapshot) addList(list kclient.ObjectList) error {
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := s.add(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package analyze
+
+import (
+	"context"
+	"testing"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/scheme"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestFromCluster(t *testing.T) {
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "my-app-namespace"}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "my-app-namespace"}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "other-namespace"}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "other-namespace"}},
+	).Build()
+
+	snapshot, err := FromCluster(context.Background(), c, "my-app-namespace")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, snapshot.Namespaces, 1)
+	assert.Len(t, snapshot.Services, 1)
+	// Pods are only read in the requested namespaces
+	if assert.Len(t, snapshot.Pods, 1) {
+		assert.Equal(t, "web", snapshot.Pods[0].Name)
+	}
+}
@@ -0,0 +1,111 @@
+package analyze
+
+import (
+	"sort"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/hostname"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const acornManagedLabel = "acorn.io/managed"
+
+// Source is an Ingress or a LoadBalancer or NodePort Service that publishes a port of a workload, which is why the
+// plugin made the port PERMISSIVE
+type Source struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+func (s Source) String() string {
+	return s.Kind + " " + s.Name
+}
+
+// portSources returns the Ingresses and Services that publish the port of the pods with the given labels, the same
+// way the plugin decides which ports to make PERMISSIVE
+func (s *Snapshot) portSources(resolver hostname.Resolver, namespace string, podLabels map[string]string, port uint32) []Source {
+	var result []Source
+
+	for _, service := range s.Services {
+		if service.Namespace != namespace || !isManaged(service.Labels) || !isPublishedService(service) ||
+			!selects(service, podLabels) {
+			continue
+		}
+		for _, servicePort := range service.Spec.Ports {
+			if uint32(servicePort.TargetPort.IntVal) == port {
+				result = append(result, Source{Kind: "Service", Name: objectKey(service.Namespace, service.Name)})
+				break
+			}
+		}
+	}
+
+	for _, ingress := range s.Ingresses {
+		if !isManaged(ingress.Labels) {
+			continue
+		}
+	rules:
+		for _, rule := range ingress.Spec.Rules {
+			if rule.HTTP == nil {
+				continue
+			}
+			for _, path := range rule.HTTP.Paths {
+				if path.Backend.Service == nil {
+					continue
+				}
+				service := s.backendService(resolver, ingress.Namespace, path.Backend.Service.Name)
+				if service == nil || service.Namespace != namespace || !selects(service, podLabels) {
+					continue
+				}
+				for _, servicePort := range service.Spec.Ports {
+					backendPort := path.Backend.Service.Port
+					if ((servicePort.Name != "" && servicePort.Name == backendPort.Name) || servicePort.Port == backendPort.Number) &&
+						uint32(servicePort.TargetPort.IntVal) == port {
+						result = append(result, Source{Kind: "Ingress", Name: objectKey(ingress.Namespace, ingress.Name)})
+						break rules
+					}
+				}
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].String() < result[j].String()
+	})
+	return result
+}
+
+// backendService returns the Service behind an Ingress backend, following the ExternalName of links
+func (s *Snapshot) backendService(resolver hostname.Resolver, namespace, name string) *corev1.Service {
+	service := s.service(namespace, name)
+	if service == nil || service.Spec.Type != corev1.ServiceTypeExternalName {
+		return service
+	}
+
+	target := resolver.Resolve(service.Spec.ExternalName)
+	if target.Kind != hostname.ClusterService {
+		return nil
+	}
+	return s.service(target.Namespace, target.Service)
+}
+
+func (s *Snapshot) service(namespace, name string) *corev1.Service {
+	for _, service := range s.Services {
+		if service.Namespace == namespace && service.Name == name {
+			return service
+		}
+	}
+	return nil
+}
+
+func isManaged(objLabels map[string]string) bool {
+	return objLabels[acornManagedLabel] == "true"
+}
+
+func isPublishedService(service *corev1.Service) bool {
+	return service.Spec.Type == corev1.ServiceTypeLoadBalancer || service.Spec.Type == corev1.ServiceTypeNodePort
+}
+
+// selects returns true if the Service has a selector that matches the pod labels
+func selects(service *corev1.Service, podLabels map[string]string) bool {
+	return len(service.Spec.Selector) > 0 && labels.SelectorFromSet(service.Spec.Selector).Matches(labels.Set(podLabels))
+}
@@ -0,0 +1,7 @@
+// Package v1 mirrors the subset of Acorn's AppInstance API that the plugin reads: the internal.acorn.io/v1
+// AppInstance custom resource, and the api.acorn.io/v1 App that Acorn's API server exposes for it. Only the fields
+// describing the ports of an app are kept, and unknown fields are ignored when decoding. The links of an app are
+// read from the ExternalName Services that Acorn creates for them, see TrackLinkTargets.
+// +k8s:deepcopy-gen=package
+// +groupName=internal.acorn.io
+package v1
@@ -0,0 +1,128 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	InternalSchemeGroupVersion = schema.GroupVersion{Group: "internal.acorn.io", Version: "v1"}
+	APISchemeGroupVersion      = schema.GroupVersion{Group: "api.acorn.io", Version: "v1"}
+)
+
+// AddToScheme registers the AppInstance and App types
+func AddToScheme(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypes(InternalSchemeGroupVersion, &AppInstance{}, &AppInstanceList{})
+	metav1.AddToGroupVersion(scheme, InternalSchemeGroupVersion)
+	scheme.AddKnownTypes(APISchemeGroupVersion, &App{}, &AppList{})
+	metav1.AddToGroupVersion(scheme, APISchemeGroupVersion)
+	return nil
+}
+
+type PublishMode string
+
+const (
+	PublishModeAll     = PublishMode("all")
+	PublishModeNone    = PublishMode("none")
+	PublishModeDefined = PublishMode("defined")
+)
+
+type Protocol string
+
+const (
+	ProtocolTCP  = Protocol("tcp")
+	ProtocolUDP  = Protocol("udp")
+	ProtocolHTTP = Protocol("http")
+)
+
+// AppInstance is a running Acorn app, in the namespace of its project
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type AppInstance struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AppInstanceSpec   `json:"spec,omitempty"`
+	Status AppInstanceStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type AppInstanceList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []AppInstance `json:"items"`
+}
+
+// App is the AppInstance as exposed by Acorn's API server
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type App struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AppInstanceSpec   `json:"spec,omitempty"`
+	Status AppInstanceStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type AppList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []App `json:"items"`
+}
+
+// AppInstanceSpec is how the app was run
+type AppInstanceSpec struct {
+	Image string `json:"image,omitempty"`
+	Stop  *bool  `json:"stop,omitempty"`
+	// PublishMode is all, none, or defined, which only publishes the ports that the Acornfile or the bindings publish
+	PublishMode PublishMode `json:"publishMode,omitempty"`
+	// Ports are the port bindings given when running the app, which can publish more ports
+	Ports []PortBinding `json:"ports,omitempty"`
+}
+
+// PortBinding publishes or exposes a port of a container of the app
+type PortBinding struct {
+	Port              int32    `json:"port,omitempty"`
+	Protocol          Protocol `json:"protocol,omitempty"`
+	Publish           bool     `json:"publish,omitempty"`
+	Hostname          string   `json:"hostname,omitempty"`
+	TargetPort        int32    `json:"targetPort,omitempty"`
+	TargetServiceName string   `json:"targetServiceName,omitempty"`
+}
+
+type AppInstanceStatus struct {
+	// Namespace is the namespace where the app runs
+	Namespace string  `json:"namespace,omitempty"`
+	AppSpec   AppSpec `json:"appSpec,omitempty"`
+}
+
+// AppSpec is the parsed Acornfile of the app
+type AppSpec struct {
+	Containers map[string]Container `json:"containers,omitempty"`
+	Jobs       map[string]Container `json:"jobs,omitempty"`
+}
+
+type Container struct {
+	Ports    []PortDef            `json:"ports,omitempty"`
+	Sidecars map[string]Container `json:"sidecars,omitempty"`
+}
+
+// PortDef is a port of a container. Port is the port of its Service, and TargetPort, if set, the port on which the
+// container listens.
+type PortDef struct {
+	Hostname   string   `json:"hostname,omitempty"`
+	Protocol   Protocol `json:"protocol,omitempty"`
+	Publish    bool     `json:"publish,omitempty"`
+	Port       int32    `json:"port,omitempty"`
+	TargetPort int32    `json:"targetPort,omitempty"`
+}
+
+// ContainerPort returns the port on which the container listens
+func (p PortDef) ContainerPort() int32 {
+	if p.TargetPort != 0 {
+		return p.TargetPort
+	}
+	return p.Port
+}
@@ -0,0 +1,105 @@
+package controller
+
+import (
+	acornv1 "github.com/acorn-io/acorn-istio-plugin/pkg/apis/acorn/v1"
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/discovery"
+)
+
+// appInstancesServed returns true if the cluster serves Acorn's AppInstances. Without them, which is the case when the
+// plugin runs before Acorn is installed, the app namespaces are reconciled from the labels of the objects that Acorn
+// creates in them. This is only checked when the plugin starts, as the AppInstances can't be watched before they are
+// served, so the plugin has to be restarted to read them once Acorn is installed.
+func appInstancesServed(client discovery.DiscoveryInterface) bool {
+	resources, err := client.ServerResourcesForGroupVersion(acornv1.InternalSchemeGroupVersion.String())
+	if err != nil {
+		if !apierror.IsNotFound(err) {
+			logrus.Warnf("Failed to discover %s, reconciling Acorn apps from labels: %v", acornv1.InternalSchemeGroupVersion, err)
+			return false
+		}
+	} else {
+		for _, resource := range resources.APIResources {
+			if resource.Name == "appinstances" {
+				return true
+			}
+		}
+	}
+	logrus.Infof("%s AppInstances aren't served, reconciling Acorn apps from labels until the plugin is restarted", acornv1.InternalSchemeGroupVersion)
+	return false
+}
+
+// appInstance returns the AppInstance running in the app namespace, or nil if AppInstances aren't served or it
+// doesn't exist, for example while the app is being deleted. Reading it through the request makes changes to the app
+// trigger the app namespace again.
+func (h Handler) appInstance(req router.Request, appNamespace *corev1.Namespace) (*acornv1.AppInstance, error) {
+	if !h.appInstances {
+		return nil, nil
+	}
+
+	app := &acornv1.AppInstance{}
+	if err := req.Get(app, appNamespace.Labels[appNamespaceLabel], appNamespace.Labels[appNameLabel]); apierror.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if app.Status.Namespace != appNamespace.Name {
+		// The app hasn't been deployed yet, or the namespace was created for another app of the same name
+		return nil, nil
+	}
+	return app, nil
+}
+
+// addAppInstancePorts adds the ports that the app publishes to the workloads of its containers. The ports of sidecars
+// belong to the workload of their container.
+func addAppInstancePorts(workloads workloadPorts, app *acornv1.AppInstance) {
+	for containerName, container := range app.Status.AppSpec.Containers {
+		selector := map[string]string{
+			appNameLabel:            app.Name,
+			appNamespaceLabel:       app.Namespace,
+			acornManagedLabel:       "true",
+			acornContainerNameLabel: containerName,
+		}
+		for _, port := range containerPorts(container) {
+			if portPublished(app, containerName, port) {
+				workloads.add(selector, uint32(port.ContainerPort()), "AppInstance", app)
+			}
+		}
+	}
+}
+
+// containerPorts returns the ports of the container and of its sidecars
+func containerPorts(container acornv1.Container) []acornv1.PortDef {
+	ports := append([]acornv1.PortDef{}, container.Ports...)
+	for _, sidecar := range container.Sidecars {
+		ports = append(ports, sidecar.Ports...)
+	}
+	return ports
+}
+
+// portPublished returns true if the port of the container is published, according to the publish mode of the app, the
+// Acornfile, and the port bindings given when running the app
+func portPublished(app *acornv1.AppInstance, containerName string, port acornv1.PortDef) bool {
+	switch app.Spec.PublishMode {
+	case acornv1.PublishModeNone:
+		return false
+	case acornv1.PublishModeAll:
+		return true
+	}
+
+	if port.Publish {
+		return true
+	}
+	for _, binding := range app.Spec.Ports {
+		if !binding.Publish || (binding.TargetServiceName != "" && binding.TargetServiceName != containerName) {
+			continue
+		}
+		// A binding without a target port publishes every port of its container
+		if binding.TargetPort == port.Port || (binding.TargetPort == 0 && binding.TargetServiceName != "") {
+			return true
+		}
+	}
+	return false
+}
@@ -2,27 +2,64 @@ package controller
 
 import (
 	"context"
+	"time"
 
 	"github.com/acorn-io/acorn-istio-plugin/pkg/scheme"
 	"github.com/acorn-io/baaah"
 	"k8s.io/client-go/kubernetes"
 )
 
+// routerName is the name of the plugin's router, which apply records in the objects that the plugin generates
+const routerName = "istio-controller"
+
 type Options struct {
 	K8s                        kubernetes.Interface
 	DebugImage                 string
+	ShutdownCommand            []string
 	AllowTrafficFromNamespaces string
+	LocalTrafficSourceCIDRs    string
+	OrphanSweepInterval        time.Duration
+	SidecarShutdownDeadline    time.Duration
+	DeleteStuckJobPods         bool
+	ProxyConcurrency           int
+	ProxyImageType             string
+	ScopeSidecarEgress         bool
+	SidecarEgressNamespaces    string
+	ExternalLinkTLSOrigination bool
+	EgressLockdown             bool
+	EgressHintInterval         time.Duration
+	ClusterDomain              string
+	IncludeProjects            string
+	ExcludeProjects            string
 }
 
 func Start(ctx context.Context, opt Options) error {
-	router, err := baaah.DefaultRouter("istio-controller", scheme.Scheme)
+	// Without a debug image, Istio sidecars are shut down by the quit-sidecar subcommand of the plugin's own image
+	if opt.DebugImage == "" {
+		image, err := selfImage(ctx, opt.K8s)
+		if err != nil {
+			return err
+		}
+		command, err := selfShutdownCommand()
+		if err != nil {
+			return err
+		}
+		opt.DebugImage, opt.ShutdownCommand = image, command
+	}
+
+	router, err := baaah.DefaultRouter(routerName, scheme.Scheme)
 	if err != nil {
 		return err
 	}
 
-	if err := RegisterRoutes(router, opt.K8s, opt.DebugImage, opt.AllowTrafficFromNamespaces); err != nil {
+	h, err := newHandler(router, opt)
+	if err != nil {
+		return err
+	}
+	if err := RegisterRoutes(router, h); err != nil {
 		return err
 	}
+	go h.ReportBlockedEgress(ctx)
 
 	return router.Start(ctx)
 }
@@ -0,0 +1,25 @@
+package controller
+
+import (
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Deenroll removes the injection label that AddLabels added to a namespace that is no longer an Acorn project, or to
+// a project that is no longer enrolled in the mesh. It handles every namespace, since the namespaces that lost their
+// labels can't be selected. The Istio objects generated for a former app namespace, or for the app namespaces of a
+// project that is no longer enrolled, don't need to be deleted here: the app namespace handlers are skipped, by their
+// selector or by EnrolledAppsOnly, so none of them returns the objects anymore and apply prunes them.
+func (h Handler) Deenroll(req router.Request, resp router.Response) error {
+	ns := req.Object.(*corev1.Namespace)
+	if ns.Annotations[injectionAddedAnnotation] != "true" || h.projectEnrolled(ns) {
+		return nil
+	}
+	if removeInjectionLabel(ns) {
+		logrus.Infof("Updating namespace %v to remove istio-injection label, it is no longer an enrolled Acorn project", ns.Name)
+		h.eventf(ns, corev1.EventTypeNormal, "Deenrolled",
+			"Removed the %s label because the namespace is no longer an Acorn project enrolled in the mesh, pods keep their sidecar until they restart", injectionLabel)
+	}
+	return req.Client.Update(req.Ctx, ns)
+}
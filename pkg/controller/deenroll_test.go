@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/scheme"
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/acorn-io/baaah/pkg/router/tester"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func namespaceRequest(ns *corev1.Namespace, objs ...kclient.Object) router.Request {
+	return router.Request{
+		Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(append(objs, ns)...).Build(),
+		Object: ns,
+		Ctx:    context.Background(),
+		GVK:    corev1.SchemeGroupVersion.WithKind("Namespace"),
+		Name:   ns.Name,
+		Key:    ns.Name,
+	}
+}
+
+func TestHandler_DeenrollAppPruned(t *testing.T) {
+	// The app labels are gone, the objects generated for the namespace are left to prune
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "my-app-namespace"}}
+	resp := &tester.Response{}
+	if err := (Handler{}).Deenroll(namespaceRequest(ns), resp); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, resp.NoPrune)
+	assert.Zero(t, resp.Delay)
+	assert.Empty(t, resp.Collected)
+}
+
+func TestHandler_DeenrollProject(t *testing.T) {
+	tests := []struct {
+		name          string
+		labels        map[string]string
+		annotations   map[string]string
+		expectedLabel string
+	}{
+		{
+			name:        "former project",
+			labels:      map[string]string{injectionLabel: "enabled"},
+			annotations: map[string]string{injectionAddedAnnotation: "true"},
+		},
+		{
+			name:          "project",
+			labels:        map[string]string{injectionLabel: "enabled", "acorn.io/project": "true"},
+			annotations:   map[string]string{injectionAddedAnnotation: "true"},
+			expectedLabel: "enabled",
+		},
+		{
+			name:          "label set manually",
+			labels:        map[string]string{injectionLabel: "enabled"},
+			expectedLabel: "enabled",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:        "acorn",
+				Labels:      tt.labels,
+				Annotations: tt.annotations,
+			}}
+			req := namespaceRequest(ns)
+			if err := (Handler{}).Deenroll(req, &tester.Response{}); err != nil {
+				t.Fatal(err)
+			}
+
+			actual := &corev1.Namespace{}
+			if err := req.Client.Get(context.Background(), kclient.ObjectKeyFromObject(ns), actual); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.expectedLabel, actual.Labels[injectionLabel])
+		})
+	}
+}
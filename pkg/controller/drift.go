@@ -0,0 +1,255 @@
+package controller
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/metrics"
+	"github.com/acorn-io/baaah/pkg/apply"
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// specHashAnnotation is the hash of the spec generated by the plugin, set by TrackOwner
+	specHashAnnotation = "acorn.io/istio-plugin-spec-hash"
+	// driftAnnotation is set by operators on a managed object to choose what happens when it is modified outside
+	// of the plugin: driftRevert (the default) or driftReport
+	driftAnnotation = "acorn.io/istio-plugin-drift"
+
+	driftRevert = "revert"
+	driftReport = "report"
+
+	// driftRecheckInterval is how long a drifted object has to be reverted before it is reported and reverted again
+	driftRecheckInterval = time.Minute
+)
+
+// specHash returns a hash of the spec of the object, which doesn't depend on the order of its fields
+func specHash(obj runtime.Object) (string, error) {
+	spec, err := specOf(obj)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// driftedObjects remembers which managed objects currently differ from their generated spec, and when their drift
+// was last handled, so that each drift is only reported once, and again while reverting it doesn't work. A nil
+// *driftedObjects is valid and reports every drift.
+type driftedObjects struct {
+	lock sync.Mutex
+	// kinds maps a kind to the keys of its drifted objects, and when their drift was last handled
+	kinds map[string]map[string]time.Time
+}
+
+func newDriftedObjects() *driftedObjects {
+	return &driftedObjects{
+		kinds: map[string]map[string]time.Time{},
+	}
+}
+
+// update records whether the object drifted, and returns true if it didn't drift before
+func (d *driftedObjects) update(kind, key string, drifted bool) bool {
+	if d == nil {
+		return drifted
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.kinds[kind] == nil {
+		d.kinds[kind] = map[string]time.Time{}
+	}
+	_, seen := d.kinds[kind][key]
+	isNew := drifted && !seen
+	if isNew {
+		d.kinds[kind][key] = now()
+	} else if !drifted {
+		delete(d.kinds[kind], key)
+	}
+	metrics.DriftedObjects.WithLabelValues(kind).Set(float64(len(d.kinds[kind])))
+	return isNew
+}
+
+// recheck returns how long to wait before checking a drifted object again, or 0 if driftRecheckInterval has passed
+// since its drift was last handled, in which case the drift is recorded as handled now
+func (d *driftedObjects) recheck(kind, key string) time.Duration {
+	if d == nil {
+		return 0
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if wait := driftRecheckInterval - now().Sub(d.kinds[kind][key]); wait > 0 {
+		return wait
+	}
+	d.kinds[kind][key] = now()
+	return 0
+}
+
+// DetectDrift compares managed objects with the spec that the plugin generated for them, as recorded by TrackOwner,
+// to find the ones that were modified outside of the plugin. Drift is counted in a metric and reported with an Event
+// on the object. Unless the object has the "acorn.io/istio-plugin-drift: report" annotation, the fields added to its
+// spec are then removed, and its owner is reconciled again, which reverts the other changes. The object is checked
+// again after driftRecheckInterval, and a DriftNotReverted warning is emitted while it still differs.
+func (h Handler) DetectDrift(req router.Request, resp router.Response) error {
+	if req.Object == nil {
+		h.driftedObjects.update(req.GVK.Kind, req.Key, false)
+		return nil
+	}
+
+	annotations := req.Object.GetAnnotations()
+	if annotations[specHashAnnotation] == "" {
+		return nil
+	}
+
+	hash, err := specHash(req.Object)
+	if err != nil {
+		return err
+	}
+	drifted := hash != annotations[specHashAnnotation]
+	isNew := h.driftedObjects.update(req.GVK.Kind, req.Key, drifted)
+	if !drifted {
+		return nil
+	}
+
+	if annotations[driftAnnotation] == driftReport {
+		if !isNew {
+			return nil
+		}
+		metrics.DriftDetected.WithLabelValues(req.GVK.Kind, driftReport).Inc()
+		logrus.Warnf("%v %s was modified outside of the plugin", req.GVK.Kind, req.Key)
+		h.eventf(req.Object, corev1.EventTypeWarning, "Drifted",
+			"%s was modified outside of the plugin. The changes are kept until the plugin reconciles it again, because of the %s: %s annotation",
+			req.GVK.Kind, driftAnnotation, driftReport)
+		return nil
+	}
+
+	if isNew {
+		metrics.DriftDetected.WithLabelValues(req.GVK.Kind, driftRevert).Inc()
+		logrus.Infof("Reverting %v %s, which was modified outside of the plugin", req.GVK.Kind, req.Key)
+		h.eventf(req.Object, corev1.EventTypeWarning, "Drifted",
+			"%s was modified outside of the plugin, reverting the changes. Set the %s: %s annotation to keep them",
+			req.GVK.Kind, driftAnnotation, driftReport)
+	} else if wait := h.driftedObjects.recheck(req.GVK.Kind, req.Key); wait > 0 {
+		// The revert is still in progress
+		resp.RetryAfter(wait)
+		return nil
+	} else {
+		logrus.Warnf("%v %s still differs from the spec generated by the plugin, reverting it again", req.GVK.Kind, req.Key)
+		h.eventf(req.Object, corev1.EventTypeWarning, "DriftNotReverted",
+			"%s still differs from the spec generated by the plugin %v after reverting it, trying again", req.GVK.Kind, driftRecheckInterval)
+	}
+	resp.RetryAfter(driftRecheckInterval)
+
+	if err := removeAddedFields(req); err != nil {
+		return err
+	}
+	gv, err := schema.ParseGroupVersion(annotations[ownerAPIVersionAnnotation])
+	if err != nil {
+		return err
+	}
+	return h.trigger.Trigger(gv.WithKind(annotations[ownerKindAnnotation]),
+		toKey(annotations[ownerNamespaceAnnotation], annotations[ownerNameAnnotation]), 0)
+}
+
+// removeAddedFields removes the fields of the spec of the object that weren't in the spec last applied by the plugin.
+// Applying the object again only reverts the fields that the plugin generated, since apply sends a three-way merge
+// patch, which keeps the fields that it didn't know about.
+func removeAddedFields(req router.Request) error {
+	applied, err := lastApplied(req.Object.GetAnnotations()[apply.LabelApplied])
+	if err != nil || applied == nil {
+		return err
+	}
+
+	data, err := json.Marshal(req.Object)
+	if err != nil {
+		return err
+	}
+	current := map[string]interface{}{}
+	if err := json.Unmarshal(data, &current); err != nil {
+		return err
+	}
+
+	appliedSpec, _ := applied["spec"].(map[string]interface{})
+	currentSpec, _ := current["spec"].(map[string]interface{})
+	if !removeAddedKeys(currentSpec, appliedSpec) {
+		return nil
+	}
+
+	if data, err = json.Marshal(current); err != nil {
+		return err
+	}
+	reverted, err := req.Client.Scheme().New(req.GVK)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, reverted); err != nil {
+		return err
+	}
+	logrus.Infof("Removing the fields added to the spec of %v %s", req.GVK.Kind, req.Key)
+	return req.Client.Update(req.Ctx, reverted.(kclient.Object))
+}
+
+// removeAddedKeys recursively removes the keys of the current map that aren't in the applied one, and returns true
+// if any was removed. Lists are left alone, since apply replaces them as a whole.
+func removeAddedKeys(current, applied map[string]interface{}) bool {
+	removed := false
+	for key, value := range current {
+		appliedValue, ok := applied[key]
+		if !ok {
+			delete(current, key)
+			removed = true
+			continue
+		}
+		currentMap, isMap := value.(map[string]interface{})
+		appliedMap, appliedIsMap := appliedValue.(map[string]interface{})
+		if isMap && appliedIsMap && removeAddedKeys(currentMap, appliedMap) {
+			removed = true
+		}
+	}
+	return removed
+}
+
+// lastApplied decodes the object last applied by the plugin, which apply records as gzipped JSON in base64, or as
+// JSON. Long strings are replaced by a hash, but the keys are kept.
+func lastApplied(annotation string) (map[string]interface{}, error) {
+	if annotation == "" {
+		return nil, nil
+	}
+
+	data := []byte(annotation)
+	if annotation[0] != '{' {
+		compressed, err := base64.RawStdEncoding.DecodeString(annotation)
+		if err != nil {
+			return nil, err
+		}
+		r, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+
+	result := map[string]interface{}{}
+	return result, json.Unmarshal(data, &result)
+}
@@ -0,0 +1,213 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/scheme"
+	"github.com/acorn-io/baaah/pkg/apply"
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/acorn-io/baaah/pkg/router/tester"
+	"github.com/stretchr/testify/assert"
+	"istio.io/api/security/v1beta1"
+	securityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/record"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+type fakeTrigger struct {
+	triggered []string
+}
+
+func (f *fakeTrigger) Trigger(gvk schema.GroupVersionKind, key string, _ time.Duration) error {
+	f.triggered = append(f.triggered, fmt.Sprintf("%s %s", gvk.Kind, key))
+	return nil
+}
+
+// generatedPeerAuthentication returns a PeerAuthentication as generated by a handler wrapped in TrackOwner
+func generatedPeerAuthentication(t *testing.T) *securityv1beta1.PeerAuthentication {
+	resp := &tester.Response{}
+	handler := TrackOwner(router.HandlerFunc(func(req router.Request, resp router.Response) error {
+		resp.Objects(peerAuthWithMode("policy", v1beta1.PeerAuthentication_MutualTLS_STRICT))
+		return nil
+	}))
+	if err := handler.Handle(router.Request{
+		GVK:  corev1.SchemeGroupVersion.WithKind("Namespace"),
+		Name: "my-app-namespace",
+	}, resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Collected[0].(*securityv1beta1.PeerAuthentication)
+}
+
+func TestHandler_DetectDrift(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        v1beta1.PeerAuthentication_MutualTLS_Mode
+		annotations map[string]string
+		events      []string
+		triggered   []string
+	}{
+		{
+			name: "unchanged",
+			mode: v1beta1.PeerAuthentication_MutualTLS_STRICT,
+		},
+		{
+			name:      "revert",
+			mode:      v1beta1.PeerAuthentication_MutualTLS_DISABLE,
+			events:    []string{"Warning Drifted PeerAuthentication was modified outside of the plugin, reverting the changes. Set the acorn.io/istio-plugin-drift: report annotation to keep them"},
+			triggered: []string{"Namespace my-app-namespace"},
+		},
+		{
+			name:        "report",
+			mode:        v1beta1.PeerAuthentication_MutualTLS_DISABLE,
+			annotations: map[string]string{driftAnnotation: driftReport},
+			events:      []string{"Warning Drifted PeerAuthentication was modified outside of the plugin. The changes are kept until the plugin reconciles it again, because of the acorn.io/istio-plugin-drift: report annotation"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			trigger := &fakeTrigger{}
+			h := Handler{
+				recorder:       recorder,
+				trigger:        trigger,
+				driftedObjects: newDriftedObjects(),
+			}
+
+			pa := generatedPeerAuthentication(t)
+			pa.Spec.Mtls.Mode = tt.mode
+			for k, v := range tt.annotations {
+				pa.Annotations[k] = v
+			}
+
+			req := router.Request{
+				GVK:       securityv1beta1.SchemeGroupVersion.WithKind("PeerAuthentication"),
+				Object:    pa,
+				Namespace: pa.Namespace,
+				Name:      pa.Name,
+				Key:       toKey(pa.Namespace, pa.Name),
+			}
+			// The drift is only handled the first time it is seen
+			for i := 0; i < 2; i++ {
+				if err := h.DetectDrift(req, &tester.Response{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			assert.Equal(t, tt.events, drainEvents(recorder))
+			assert.Equal(t, tt.triggered, trigger.triggered)
+		})
+	}
+}
+
+func TestHandler_DetectDriftAddedField(t *testing.T) {
+	setNow(t, "2023-03-01T10:00:00Z")
+	recorder := record.NewFakeRecorder(10)
+	trigger := &fakeTrigger{}
+	h := Handler{
+		recorder:       recorder,
+		trigger:        trigger,
+		driftedObjects: newDriftedObjects(),
+	}
+
+	// apply records the object that it applied, a port added to the spec isn't removed by its three-way merge patch
+	pa := generatedPeerAuthentication(t)
+	applied, err := json.Marshal(pa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pa.Annotations[apply.LabelApplied] = string(applied)
+	pa.Spec.PortLevelMtls = map[uint32]*v1beta1.PeerAuthentication_MutualTLS{
+		8080: {Mode: v1beta1.PeerAuthentication_MutualTLS_DISABLE},
+	}
+
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(pa).Build()
+	detect := func() *tester.Response {
+		current := &securityv1beta1.PeerAuthentication{}
+		if err := c.Get(context.Background(), kclient.ObjectKeyFromObject(pa), current); err != nil {
+			t.Fatal(err)
+		}
+		resp := &tester.Response{}
+		if err := h.DetectDrift(router.Request{
+			Client:    c,
+			Ctx:       context.Background(),
+			GVK:       securityv1beta1.SchemeGroupVersion.WithKind("PeerAuthentication"),
+			Object:    current,
+			Namespace: current.Namespace,
+			Name:      current.Name,
+			Key:       toKey(current.Namespace, current.Name),
+		}, resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := detect()
+	assert.Equal(t, driftRecheckInterval, resp.Delay)
+	assert.Equal(t, []string{"Warning Drifted PeerAuthentication was modified outside of the plugin, reverting the changes. Set the acorn.io/istio-plugin-drift: report annotation to keep them"},
+		drainEvents(recorder))
+	assert.Equal(t, []string{"Namespace my-app-namespace"}, trigger.triggered)
+
+	reverted := &securityv1beta1.PeerAuthentication{}
+	if err := c.Get(context.Background(), kclient.ObjectKeyFromObject(pa), reverted); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, reverted.Spec.PortLevelMtls)
+	assert.Equal(t, v1beta1.PeerAuthentication_MutualTLS_STRICT, reverted.Spec.Mtls.Mode)
+
+	// The object no longer drifts
+	detect()
+	assert.Empty(t, drainEvents(recorder))
+	assert.Len(t, trigger.triggered, 1)
+}
+
+func TestHandler_DetectDriftNotReverted(t *testing.T) {
+	setNow(t, "2023-03-01T10:00:00Z")
+	recorder := record.NewFakeRecorder(10)
+	trigger := &fakeTrigger{}
+	h := Handler{
+		recorder:       recorder,
+		trigger:        trigger,
+		driftedObjects: newDriftedObjects(),
+	}
+
+	pa := generatedPeerAuthentication(t)
+	pa.Spec.Mtls.Mode = v1beta1.PeerAuthentication_MutualTLS_DISABLE
+	req := router.Request{
+		GVK:       securityv1beta1.SchemeGroupVersion.WithKind("PeerAuthentication"),
+		Object:    pa,
+		Namespace: pa.Namespace,
+		Name:      pa.Name,
+		Key:       toKey(pa.Namespace, pa.Name),
+	}
+	detect := func() *tester.Response {
+		resp := &tester.Response{}
+		if err := h.DetectDrift(req, resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	detect()
+	assert.Len(t, drainEvents(recorder), 1)
+
+	// The revert is still in progress
+	setNow(t, "2023-03-01T10:00:20Z")
+	assert.Equal(t, 40*time.Second, detect().Delay)
+	assert.Empty(t, drainEvents(recorder))
+
+	// The object still drifts after the revert, which is reported and tried again
+	setNow(t, "2023-03-01T10:01:00Z")
+	assert.Equal(t, driftRecheckInterval, detect().Delay)
+	assert.Equal(t, []string{"Warning DriftNotReverted PeerAuthentication still differs from the spec generated by the plugin 1m0s after reverting it, trying again"},
+		drainEvents(recorder))
+	assert.Equal(t, []string{"Namespace my-app-namespace", "Namespace my-app-namespace"}, trigger.triggered)
+}
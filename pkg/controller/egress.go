@@ -0,0 +1,190 @@
+package controller
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/hostname"
+	"github.com/acorn-io/baaah/pkg/name"
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/sirupsen/logrus"
+	networkingapiv1beta1 "istio.io/api/networking/v1beta1"
+	networkingv1beta1 "istio.io/client-go/pkg/apis/networking/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	istioNamespace = "istio-system"
+
+	// egressLockdownAnnotation set to "true" or "false" on an app overrides whether its egress is locked down
+	egressLockdownAnnotation = "acorn.io/istio-egress-lockdown"
+	// allowedEgressHostsAnnotation lists the external hosts that a locked down app can reach (comma-separated).
+	// Hosts can start with a "*." wildcard.
+	allowedEgressHostsAnnotation = "acorn.io/istio-allowed-egress-hosts"
+)
+
+// SidecarForApp creates an Istio Sidecar in each app's namespace that limits the configuration pushed to the app's
+// proxies to the services of the namespaces it can talk to: its own, the ones of its links, istio-system, and the
+// configured extra namespaces. Without it, every proxy receives the configuration of the entire mesh.
+// Listing the links registers a watch on them, so the Sidecar is updated whenever links are added or removed.
+// When egress is locked down for the app, the Sidecar also sets the outbound traffic policy to REGISTRY_ONLY, and
+// ServiceEntries register the external hosts that the app is allowed to reach.
+func (h Handler) SidecarForApp(req router.Request, resp router.Response) error {
+	appNamespace := req.Object.(*corev1.Namespace)
+	invalidHosts := h.warnings(req, "InvalidEgressHost")
+
+	lockdown := h.egressLockdownEnabled(appNamespace)
+	if !h.scopeSidecarEgress && !lockdown {
+		invalidHosts.flush()
+		return nil
+	}
+
+	hosts := []string{"*/*"}
+	if h.scopeSidecarEgress {
+		var err error
+		if hosts, err = h.scopedEgressHosts(req, appNamespace.Name); err != nil {
+			return err
+		}
+	}
+
+	sidecar := &networkingv1beta1.Sidecar{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name.SafeConcatName(appNamespace.Name, "sidecar"),
+			Namespace: appNamespace.Name,
+			Labels: map[string]string{
+				acornManagedLabel: "true",
+			},
+		},
+		Spec: networkingapiv1beta1.Sidecar{
+			Egress: []*networkingapiv1beta1.IstioEgressListener{{
+				Hosts: hosts,
+			}},
+		},
+	}
+	if !lockdown {
+		resp.Objects(sidecar)
+		invalidHosts.flush()
+		return nil
+	}
+
+	// REGISTRY_ONLY is the zero value of the mode, so the policy is serialized as "{}", which Istio reads the same way
+	sidecar.Spec.OutboundTrafficPolicy = &networkingapiv1beta1.OutboundTrafficPolicy{
+		Mode: networkingapiv1beta1.OutboundTrafficPolicy_REGISTRY_ONLY,
+	}
+	resp.Objects(sidecar)
+	resp.Objects(h.allowedEgressServiceEntries(invalidHosts, appNamespace)...)
+	invalidHosts.flush()
+	return nil
+}
+
+// scopedEgressHosts returns the egress hosts of the Sidecar of an app: the app's own namespace first, then
+// the namespaces of its links, istio-system, and the extra namespaces
+func (h Handler) scopedEgressHosts(req router.Request, appNamespace string) ([]string, error) {
+	links := corev1.ServiceList{}
+	linkSelector, err := getLinkSelector()
+	if err != nil {
+		return nil, err
+	}
+	if err := req.List(&links, &kclient.ListOptions{
+		Namespace:     appNamespace,
+		LabelSelector: linkSelector,
+	}); err != nil {
+		return nil, err
+	}
+
+	namespaces := map[string]bool{
+		istioNamespace: true,
+	}
+	for _, namespace := range h.sidecarEgressNamespaces {
+		namespaces[namespace] = true
+	}
+	for _, link := range links.Items {
+		if link.Spec.Type != corev1.ServiceTypeExternalName {
+			continue
+		}
+		if target := h.resolver.Resolve(link.Spec.ExternalName); target.Kind == hostname.ClusterService {
+			namespaces[target.Namespace] = true
+		}
+	}
+	delete(namespaces, appNamespace)
+
+	hosts := make([]string, 0, len(namespaces))
+	for namespace := range namespaces {
+		hosts = append(hosts, namespace+"/*")
+	}
+	sort.Strings(hosts)
+
+	return append([]string{"./*"}, hosts...), nil
+}
+
+// egressLockdownEnabled returns true if the app only allows egress to registered hosts, either because it opted in
+// or because it is the default and the app didn't opt out
+func (h Handler) egressLockdownEnabled(appNamespace *corev1.Namespace) bool {
+	switch appNamespace.Annotations[egressLockdownAnnotation] {
+	case "true":
+		return true
+	case "false":
+		return false
+	default:
+		return h.egressLockdown
+	}
+}
+
+// allowedEgressServiceEntries returns the ServiceEntries that register the hosts listed in the allowed egress hosts
+// annotation of the app, on the HTTP and HTTPS ports. Wildcard hosts can't be resolved through DNS, so they get a
+// separate ServiceEntry that forwards traffic to the address requested by the app. Invalid hosts are skipped and added
+// to invalidHosts.
+func (h Handler) allowedEgressServiceEntries(invalidHosts *warnings, appNamespace *corev1.Namespace) []kclient.Object {
+	var dnsHosts, wildcardHosts []string
+	for _, host := range splitList(appNamespace.Annotations[allowedEgressHostsAnnotation]) {
+		host = strings.ToLower(host)
+		wildcard := strings.HasPrefix(host, "*.")
+		if errs := validation.IsDNS1123Subdomain(strings.TrimPrefix(host, "*.")); len(errs) > 0 {
+			invalidHosts.add(host, func() {
+				logrus.Warnf("Ignoring invalid egress host %q of namespace %s: %s", host, appNamespace.Name, strings.Join(errs, ", "))
+				h.eventf(appNamespace, corev1.EventTypeWarning, "InvalidEgressHost",
+					"Ignoring invalid egress host %q: %s", host, strings.Join(errs, ", "))
+			})
+			continue
+		}
+		if wildcard {
+			wildcardHosts = append(wildcardHosts, host)
+		} else {
+			dnsHosts = append(dnsHosts, host)
+		}
+	}
+
+	var result []kclient.Object
+	if len(dnsHosts) > 0 {
+		result = append(result, allowedEgressServiceEntry(appNamespace.Name, "allowed-egress", dnsHosts, networkingapiv1beta1.ServiceEntry_DNS))
+	}
+	if len(wildcardHosts) > 0 {
+		result = append(result, allowedEgressServiceEntry(appNamespace.Name, "allowed-egress-wildcard", wildcardHosts, networkingapiv1beta1.ServiceEntry_NONE))
+	}
+	return result
+}
+
+func allowedEgressServiceEntry(namespace, suffix string, hosts []string, resolution networkingapiv1beta1.ServiceEntry_Resolution) *networkingv1beta1.ServiceEntry {
+	return &networkingv1beta1.ServiceEntry{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name.SafeConcatName(namespace, suffix),
+			Namespace: namespace,
+			Labels: map[string]string{
+				acornManagedLabel: "true",
+			},
+		},
+		Spec: networkingapiv1beta1.ServiceEntry{
+			Hosts:      hosts,
+			Location:   networkingapiv1beta1.ServiceEntry_MESH_EXTERNAL,
+			Resolution: resolution,
+			ExportTo:   []string{"."},
+			Ports: []*networkingapiv1beta1.Port{
+				{Number: 80, Protocol: "HTTP", Name: "http-80"},
+				{Number: 443, Protocol: "TLS", Name: "tls-443"},
+			},
+		},
+	}
+}
@@ -0,0 +1,273 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// proxyStatsPort is the port on which the Istio proxy serves its Prometheus metrics on the pod IP
+	proxyStatsPort = "15090"
+	// blackHoleCluster is the destination of the requests and connections that Envoy refused because their
+	// destination isn't registered
+	blackHoleCluster = "BlackHoleCluster"
+	// unknownHost is reported for the blocked connections whose destination host isn't known, such as TLS or TCP
+	// connections to an IP address
+	unknownHost = "unknown"
+)
+
+// blockedMetrics are the Istio standard metrics, reported by the proxy of the client, that count the blocked
+// requests and connections by destination
+var blockedMetrics = []string{"istio_requests_total", "istio_tcp_connections_opened_total"}
+
+// fetchProxyStats is replaced in tests
+var fetchProxyStats = defaultFetchProxyStats
+
+func defaultFetchProxyStats(ctx context.Context, pod *corev1.Pod) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("http://%s/stats/prometheus", net.JoinHostPort(pod.Status.PodIP, proxyStatsPort)), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// blockedHosts counts the blocked requests and connections by destination host
+type blockedHosts map[string]int64
+
+// String lists the hosts, most blocked first
+func (b blockedHosts) String() string {
+	hosts := make([]string, 0, len(b))
+	for host := range b {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if b[hosts[i]] != b[hosts[j]] {
+			return b[hosts[i]] > b[hosts[j]]
+		}
+		return hosts[i] < hosts[j]
+	})
+
+	parts := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		parts = append(parts, fmt.Sprintf("%s (%d)", host, b[host]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// blockedConnections remembers how many requests and connections to each host were blocked by the proxies of each
+// namespace, so that only new ones are reported. A nil *blockedConnections is valid and reports every blocked host.
+type blockedConnections struct {
+	lock       sync.Mutex
+	namespaces map[string]map[types.UID]blockedHosts
+}
+
+func newBlockedConnections() *blockedConnections {
+	return &blockedConnections{
+		namespaces: map[string]map[types.UID]blockedHosts{},
+	}
+}
+
+// update records the blocked hosts of every running pod in the namespace, forgetting the pods that are gone, and
+// returns the new blocked requests and connections of each pod
+func (b *blockedConnections) update(namespace string, counts map[types.UID]blockedHosts) map[types.UID]blockedHosts {
+	if b == nil {
+		return counts
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	result := map[types.UID]blockedHosts{}
+	for pod, hosts := range counts {
+		for host, count := range hosts {
+			previous := b.namespaces[namespace][pod][host]
+			if count < previous {
+				// The proxy restarted
+				previous = 0
+			}
+			if count > previous {
+				if result[pod] == nil {
+					result[pod] = blockedHosts{}
+				}
+				result[pod][host] = count - previous
+			}
+		}
+	}
+	b.namespaces[namespace] = counts
+	return result
+}
+
+// retain forgets the namespaces that aren't checked anymore
+func (b *blockedConnections) retain(namespaces map[string]bool) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for namespace := range b.namespaces {
+		if !namespaces[namespace] {
+			delete(b.namespaces, namespace)
+		}
+	}
+}
+
+// ReportBlockedEgress checks the Istio proxies of the apps whose egress is locked down for requests and connections
+// that were blocked because their destination isn't registered, every --egress-hint-interval until the context is
+// done, and emits a Warning Event on the pod listing the hosts when there are new ones. It runs outside of the
+// router, so that scraping the proxies doesn't hold up the handlers.
+func (h Handler) ReportBlockedEgress(ctx context.Context) {
+	if h.egressHintInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(h.egressHintInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.checkBlockedEgress(ctx); err != nil {
+				logrus.Errorf("Failed to check the Istio proxies for blocked egress: %v", err)
+			}
+		}
+	}
+}
+
+// checkBlockedEgress checks the proxies of every enrolled app namespace whose egress is locked down
+func (h Handler) checkBlockedEgress(ctx context.Context) error {
+	// The projects are needed to tell whether the app namespaces are enrolled
+	namespaces, err := h.client.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	byName := map[string]*corev1.Namespace{}
+	for i := range namespaces.Items {
+		byName[namespaces.Items[i].Name] = &namespaces.Items[i]
+	}
+
+	checked := map[string]bool{}
+	for _, ns := range byName {
+		projectName, ok := ns.Labels[appNamespaceLabel]
+		if !ok || !h.egressLockdownEnabled(ns) {
+			continue
+		}
+		if project := byName[projectName]; project == nil || !h.projectEnrolled(project) {
+			continue
+		}
+
+		checked[ns.Name] = true
+		if err := h.checkNamespaceBlockedEgress(ctx, ns.Name); err != nil {
+			return err
+		}
+	}
+	h.blockedConnections.retain(checked)
+	return nil
+}
+
+func (h Handler) checkNamespaceBlockedEgress(ctx context.Context, namespace string) error {
+	pods, err := h.client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	counts := map[types.UID]blockedHosts{}
+	byUID := map[types.UID]*corev1.Pod{}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase != corev1.PodRunning || pod.Status.PodIP == "" || !sidecarRunning(pod) {
+			continue
+		}
+
+		blocked, err := podBlockedHosts(ctx, pod)
+		if err != nil {
+			logrus.Debugf("Failed to get the proxy stats of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+			continue
+		}
+		counts[pod.UID] = blocked
+		byUID[pod.UID] = pod
+	}
+
+	for uid, hosts := range h.blockedConnections.update(namespace, counts) {
+		if len(hosts) > 0 {
+			h.eventf(byUID[uid], corev1.EventTypeWarning, "EgressBlocked",
+				"Istio proxy blocked requests to hosts that aren't registered: %s. If the app needs to reach them, add them to the %s annotation of the app",
+				hosts, allowedEgressHostsAnnotation)
+		}
+	}
+	return nil
+}
+
+// podBlockedHosts returns the number of blocked requests and connections of the pod by destination host, from the
+// destination_service label of the Istio standard metrics
+func podBlockedHosts(ctx context.Context, pod *corev1.Pod) (blockedHosts, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	stats, err := fetchProxyStats(ctx, pod)
+	if err != nil {
+		return nil, err
+	}
+	defer stats.Close()
+
+	parser := expfmt.TextParser{}
+	families, err := parser.TextToMetricFamilies(stats)
+	if err != nil {
+		return nil, err
+	}
+
+	result := blockedHosts{}
+	for _, name := range blockedMetrics {
+		family := families[name]
+		if family == nil {
+			continue
+		}
+		for _, metric := range family.Metric {
+			labels := metricLabels(metric)
+			if labels["reporter"] != "source" || labels["destination_service_name"] != blackHoleCluster {
+				continue
+			}
+			host := labels["destination_service"]
+			if host == "" || host == blackHoleCluster {
+				host = unknownHost
+			}
+			if metric.Counter != nil {
+				result[host] += int64(metric.Counter.GetValue())
+			}
+		}
+	}
+	return result, nil
+}
+
+func metricLabels(metric *dto.Metric) map[string]string {
+	result := map[string]string{}
+	for _, label := range metric.Label {
+		result[label.GetName()] = label.GetValue()
+	}
+	return result
+}
@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestHandler_CheckBlockedEgress(t *testing.T) {
+	blocked := map[string]string{}
+	fetchProxyStats = func(ctx context.Context, pod *corev1.Pod) (io.ReadCloser, error) {
+		stats := `# TYPE istio_requests_total counter
+istio_requests_total{reporter="source",destination_service="web.foo.svc.cluster.local",destination_service_name="web",response_code="200"} 12
+istio_requests_total{reporter="source",destination_service="api.example.com",destination_service_name="BlackHoleCluster",response_code="502"} ` + blocked["api.example.com"] + `
+# TYPE istio_tcp_connections_opened_total counter
+istio_tcp_connections_opened_total{reporter="source",destination_service="unknown",destination_service_name="BlackHoleCluster"} ` + blocked["unknown"] + "\n"
+		return io.NopCloser(strings.NewReader(stats)), nil
+	}
+	defer func() { fetchProxyStats = defaultFetchProxyStats }()
+
+	project := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "acorn",
+			Labels: map[string]string{"acorn.io/project": "true"},
+		},
+	}
+	appNamespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "foo",
+			Labels: map[string]string{appNamespaceLabel: "acorn"},
+			Annotations: map[string]string{
+				egressLockdownAnnotation: "true",
+			},
+		},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo-app",
+			Namespace: "foo",
+			UID:       "1234",
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			PodIP: "10.42.0.12",
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name: proxySidecarContainerName,
+				State: corev1.ContainerState{
+					Running: &corev1.ContainerStateRunning{},
+				},
+			}},
+		},
+	}
+
+	recorder := record.NewFakeRecorder(10)
+	h := Handler{
+		client:             fake.NewSimpleClientset(project, appNamespace, pod),
+		recorder:           recorder,
+		egressHintInterval: time.Minute,
+		blockedConnections: newBlockedConnections(),
+	}
+
+	check := func() {
+		if err := h.checkBlockedEgress(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing was blocked yet
+	blocked = map[string]string{"api.example.com": "0", "unknown": "0"}
+	check()
+	assert.Len(t, recorder.Events, 0)
+
+	// Requests to a host were blocked
+	blocked = map[string]string{"api.example.com": "10", "unknown": "0"}
+	check()
+	assert.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "hosts that aren't registered: api.example.com (10).")
+
+	// Nothing new was blocked
+	check()
+	assert.Len(t, recorder.Events, 0)
+
+	// Only the new requests and connections are reported
+	blocked = map[string]string{"api.example.com": "12", "unknown": "3"}
+	check()
+	assert.Contains(t, <-recorder.Events, "hosts that aren't registered: unknown (3), api.example.com (2).")
+
+	// Apps in projects that aren't enrolled aren't checked
+	h.projects, _ = newProjectFilter("", "acorn")
+	blocked = map[string]string{"api.example.com": "20", "unknown": "3"}
+	check()
+	assert.Len(t, recorder.Events, 0)
+}
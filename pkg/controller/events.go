@@ -0,0 +1,254 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/scheme"
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+const eventSourceComponent = "acorn-istio-plugin"
+
+func newRecorder(client kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventSourceComponent})
+}
+
+// eventf records an Event on the object, unless the handler has no recorder
+func (h Handler) eventf(obj runtime.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	if h.recorder == nil || obj == nil || reflect.ValueOf(obj).IsNil() {
+		return
+	}
+	h.recorder.Eventf(obj, eventType, reason, messageFmt, args...)
+}
+
+// RecordEvents is a middleware that emits an Event on the object being handled for every object that the handler
+// creates or updates, and a Warning Event when the handler fails, so that app owners see what the plugin did with
+// kubectl describe instead of having to read its logs. The objects are only applied once the handler returns, so the
+// Created and Updated Events are held until ConfirmChanges sees the applied object. An object that fails to apply is
+// reported by the ReconcileFailed Event of the retry instead.
+func (h Handler) RecordEvents(next router.Handler) router.Handler {
+	return router.HandlerFunc(func(req router.Request, resp router.Response) error {
+		err := next.Handle(req, eventRecordingResponse{
+			Response: resp,
+			handler:  h,
+			req:      req,
+		})
+		if err != nil && req.Object != nil {
+			h.eventf(req.Object, corev1.EventTypeWarning, "ReconcileFailed", "Failed to reconcile Istio configuration: %v", err)
+		}
+		return err
+	})
+}
+
+type eventRecordingResponse struct {
+	router.Response
+	handler Handler
+	req     router.Request
+}
+
+func (e eventRecordingResponse) Objects(objs ...kclient.Object) {
+	for _, obj := range objs {
+		change, err := changeOf(e.req, obj)
+		if err != nil {
+			logrus.Debugf("Failed to compare %s/%s with the existing object: %v", obj.GetNamespace(), obj.GetName(), err)
+			continue
+		}
+		if change == "" {
+			continue
+		}
+
+		kind := objectKind(e.req.Client.Scheme(), obj)
+		e.handler.eventfOnApply(obj, e.req.Object, corev1.EventTypeNormal, change+kind, "%s %s %s", change, kind,
+			toKey(obj.GetNamespace(), obj.GetName()))
+	}
+	e.Response.Objects(objs...)
+}
+
+// changeOf returns "Created" if the object doesn't exist yet, "Updated" if its spec is different from the existing
+// object, and an empty string otherwise. Reading the object through the request registers a watch on it, as applying
+// it does, so that the handler runs again when it changes.
+func changeOf(req router.Request, obj kclient.Object) (string, error) {
+	gvk, err := apiutil.GVKForObject(obj, req.Client.Scheme())
+	if err != nil {
+		return "", err
+	}
+	newObj, err := req.Client.Scheme().New(gvk)
+	if err != nil {
+		return "", err
+	}
+	existing, ok := newObj.(kclient.Object)
+	if !ok {
+		return "", nil
+	}
+
+	if err := req.Client.Get(req.Ctx, kclient.ObjectKey{Namespace: obj.GetNamespace(), Name: obj.GetName()}, existing); apierror.IsNotFound(err) {
+		return "Created", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	desiredSpec, err := specOf(obj)
+	if err != nil {
+		return "", err
+	}
+	existingSpec, err := specOf(existing)
+	if err != nil {
+		return "", err
+	}
+	if reflect.DeepEqual(desiredSpec, existingSpec) {
+		return "", nil
+	}
+	return "Updated", nil
+}
+
+// objectKind returns the kind of the object, or an empty string if it isn't registered in the scheme
+func objectKind(scheme *runtime.Scheme, obj runtime.Object) string {
+	gvk, err := apiutil.GVKForObject(obj, scheme)
+	if err != nil {
+		return ""
+	}
+	return gvk.Kind
+}
+
+// eventfOnApply records an Event on the owner about a change of the object, which ConfirmChanges emits once the
+// object is applied with its current spec. The Event is dropped if the object is applied with another spec, which
+// its own Event describes.
+func (h Handler) eventfOnApply(obj kclient.Object, owner runtime.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	if owner == nil || reflect.ValueOf(owner).IsNil() {
+		return
+	}
+	hash, err := specHash(obj)
+	if err != nil {
+		logrus.Debugf("Failed to hash the spec of %s/%s, dropping the %s Event: %v", obj.GetNamespace(), obj.GetName(), reason, err)
+		return
+	}
+	h.pendingChanges.add(objectKind(scheme.Scheme, obj), toKey(obj.GetNamespace(), obj.GetName()), hash, pendingEvent{
+		owner:     owner.DeepCopyObject(),
+		eventType: eventType,
+		reason:    reason,
+		message:   fmt.Sprintf(messageFmt, args...),
+	})
+}
+
+// pendingEvent is an Event recorded by eventfOnApply
+type pendingEvent struct {
+	owner     runtime.Object
+	eventType string
+	reason    string
+	message   string
+}
+
+// pendingChange holds the Events about an object, emitted once the object is applied with the spec of the given hash
+type pendingChange struct {
+	hash   string
+	events []pendingEvent
+}
+
+// pendingChanges holds the Events about the objects that haven't been applied yet, by kind and key. A nil
+// *pendingChanges is valid and drops the Events.
+type pendingChanges struct {
+	lock  sync.Mutex
+	kinds map[string]map[string]pendingChange
+}
+
+func newPendingChanges() *pendingChanges {
+	return &pendingChanges{
+		kinds: map[string]map[string]pendingChange{},
+	}
+}
+
+// add records the Event, unless the same Event is already pending for the spec. The pending Events of an earlier
+// reconcile whose spec wasn't applied are dropped.
+func (p *pendingChanges) add(kind, key, hash string, event pendingEvent) {
+	if p == nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.kinds[kind] == nil {
+		p.kinds[kind] = map[string]pendingChange{}
+	}
+	change := p.kinds[kind][key]
+	if change.hash != hash {
+		change = pendingChange{hash: hash}
+	}
+	for _, pending := range change.events {
+		if pending.reason == event.reason && pending.message == event.message && reflect.DeepEqual(pending.owner, event.owner) {
+			return
+		}
+	}
+	change.events = append(change.events, event)
+	p.kinds[kind][key] = change
+}
+
+// confirm returns the pending Events of the object and forgets them if the object was applied with their spec, as
+// recorded in the hash annotation set by TrackOwner
+func (p *pendingChanges) confirm(kind, key, hash string) []pendingEvent {
+	if p == nil {
+		return nil
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	change, ok := p.kinds[kind][key]
+	if !ok || change.hash != hash {
+		return nil
+	}
+	delete(p.kinds[kind], key)
+	return change.events
+}
+
+// forget drops the pending change of an object that was deleted
+func (p *pendingChanges) forget(kind, key string) {
+	if p == nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.kinds[kind], key)
+}
+
+// ConfirmChanges emits the Events recorded with eventfOnApply for the managed object, such as the Created or Updated
+// Event of RecordEvents, once the object was applied with the spec that the handler generated
+func (h Handler) ConfirmChanges(req router.Request, resp router.Response) error {
+	if req.Object == nil {
+		h.pendingChanges.forget(req.GVK.Kind, req.Key)
+		return nil
+	}
+
+	for _, event := range h.pendingChanges.confirm(req.GVK.Kind, req.Key, req.Object.GetAnnotations()[specHashAnnotation]) {
+		h.eventf(event.owner, event.eventType, event.reason, "%s", event.message)
+	}
+	return nil
+}
+
+func specOf(obj runtime.Object) (interface{}, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields["spec"], nil
+}
@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/scheme"
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/acorn-io/baaah/pkg/router/tester"
+	"github.com/stretchr/testify/assert"
+	"istio.io/api/security/v1beta1"
+	securityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func peerAuthWithMode(name string, mode v1beta1.PeerAuthentication_MutualTLS_Mode) *securityv1beta1.PeerAuthentication {
+	return &securityv1beta1.PeerAuthentication{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "my-app-namespace",
+		},
+		Spec: v1beta1.PeerAuthentication{
+			Mtls: &v1beta1.PeerAuthentication_MutualTLS{
+				Mode: mode,
+			},
+		},
+	}
+}
+
+func TestHandler_RecordEvents(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	h := Handler{recorder: recorder, pendingChanges: newPendingChanges()}
+
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "my-app-namespace"}}
+	req := router.Request{
+		Ctx: context.Background(),
+		Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+			peerAuthWithMode("changed", v1beta1.PeerAuthentication_MutualTLS_PERMISSIVE),
+			peerAuthWithMode("unchanged", v1beta1.PeerAuthentication_MutualTLS_STRICT),
+		).Build(),
+		Object: namespace,
+	}
+
+	handler := h.RecordEvents(router.HandlerFunc(func(req router.Request, resp router.Response) error {
+		resp.Objects(
+			peerAuthWithMode("created", v1beta1.PeerAuthentication_MutualTLS_STRICT),
+			peerAuthWithMode("changed", v1beta1.PeerAuthentication_MutualTLS_STRICT),
+			peerAuthWithMode("unchanged", v1beta1.PeerAuthentication_MutualTLS_STRICT),
+		)
+		return nil
+	}))
+
+	resp := &tester.Response{}
+	if err := handler.Handle(req, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every object is still applied, whether it changed or not
+	assert.Len(t, resp.Collected, 3)
+	// Nothing is reported until the objects are applied
+	assert.Empty(t, drainEvents(recorder))
+
+	confirm := func(obj *securityv1beta1.PeerAuthentication, hash string) {
+		obj.Annotations = map[string]string{specHashAnnotation: hash}
+		if err := h.ConfirmChanges(router.Request{
+			Object: obj,
+			GVK:    securityv1beta1.SchemeGroupVersion.WithKind("PeerAuthentication"),
+			Key:    toKey(obj.Namespace, obj.Name),
+		}, &tester.Response{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash, err := specHash(peerAuthWithMode("", v1beta1.PeerAuthentication_MutualTLS_STRICT))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The update failed to apply, the object still has the spec of the previous reconcile
+	confirm(peerAuthWithMode("changed", v1beta1.PeerAuthentication_MutualTLS_PERMISSIVE), "previous")
+	assert.Empty(t, drainEvents(recorder))
+
+	confirm(peerAuthWithMode("created", v1beta1.PeerAuthentication_MutualTLS_STRICT), hash)
+	confirm(peerAuthWithMode("changed", v1beta1.PeerAuthentication_MutualTLS_STRICT), hash)
+	// Seeing the object again doesn't repeat the Event
+	confirm(peerAuthWithMode("created", v1beta1.PeerAuthentication_MutualTLS_STRICT), hash)
+	assert.Equal(t, []string{
+		"Normal CreatedPeerAuthentication Created PeerAuthentication my-app-namespace/created",
+		"Normal UpdatedPeerAuthentication Updated PeerAuthentication my-app-namespace/changed",
+	}, drainEvents(recorder))
+}
+
+func TestHandler_RecordEventsFailure(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	h := Handler{recorder: recorder}
+
+	req := router.Request{
+		Ctx:    context.Background(),
+		Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).Build(),
+		Object: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "my-app-namespace"}},
+	}
+	handler := h.RecordEvents(router.HandlerFunc(func(req router.Request, resp router.Response) error {
+		return errors.New("failed to find service 'foo'")
+	}))
+
+	assert.Error(t, handler.Handle(req, &tester.Response{}))
+	assert.Equal(t, []string{
+		"Warning ReconcileFailed Failed to reconcile Istio configuration: failed to find service 'foo'",
+	}, drainEvents(recorder))
+}
+
+func TestHandler_PoliciesForWorkloadsPortsOpened(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	h := Handler{recorder: recorder, pendingChanges: newPendingChanges()}
+
+	// The existing PeerAuthentication already makes port 8080 PERMISSIVE, only 9090 is new
+	resp := clusterTest(t, "testdata/ports-opened", h.PoliciesForWorkloads)
+	// Nothing is reported until the PeerAuthentication is applied
+	assert.Empty(t, drainEvents(recorder))
+
+	for _, obj := range resp.Collected {
+		peerAuth, ok := obj.(*securityv1beta1.PeerAuthentication)
+		if !ok {
+			continue
+		}
+		hash, err := specHash(peerAuth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peerAuth.Annotations = map[string]string{specHashAnnotation: hash}
+		if err := h.ConfirmChanges(router.Request{
+			Object: peerAuth,
+			GVK:    securityv1beta1.SchemeGroupVersion.WithKind("PeerAuthentication"),
+			Key:    toKey(peerAuth.Namespace, peerAuth.Name),
+		}, &tester.Response{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, []string{
+		"Normal PortsOpened Set mTLS to PERMISSIVE on port(s) 9090 of the pods matching " +
+			"acorn.io/app-name=my-app,acorn.io/app-namespace=acorn,acorn.io/managed=true,port-number.acorn.io/8080=true,port-number.acorn.io/9090=true,service-name.acorn.io/one=true " +
+			"in namespace my-app-namespace, to accept traffic from outside the mesh",
+	}, drainEvents(recorder))
+}
+
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var result []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			result = append(result, event)
+		default:
+			return result
+		}
+	}
+}
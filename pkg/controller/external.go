@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	networkingapiv1beta1 "istio.io/api/networking/v1beta1"
+	networkingv1beta1 "istio.io/client-go/pkg/apis/networking/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// tlsOriginationPort is the port that plaintext HTTP traffic to an external link is sent to once the proxy upgraded
+// it to TLS
+const tlsOriginationPort = 443
+
+// objectsForExternalLink returns a ServiceEntry that registers the external host targeted by a link in the mesh, so
+// that the link keeps working when the outbound traffic policy is REGISTRY_ONLY. If TLS origination is enabled, it
+// also returns a DestinationRule that makes the proxy upgrade the plaintext HTTP traffic of the app to TLS.
+func (h Handler) objectsForExternalLink(service *corev1.Service, host string) []kclient.Object {
+	serviceEntry := &networkingv1beta1.ServiceEntry{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      service.Name,
+			Namespace: service.Namespace,
+			Labels: map[string]string{
+				acornManagedLabel: "true",
+			},
+		},
+		Spec: networkingapiv1beta1.ServiceEntry{
+			Hosts:      []string{host},
+			Location:   networkingapiv1beta1.ServiceEntry_MESH_EXTERNAL,
+			Resolution: networkingapiv1beta1.ServiceEntry_DNS,
+			// Only the app's namespace needs to know about this host
+			ExportTo: []string{"."},
+		},
+	}
+
+	var tlsPorts []*networkingapiv1beta1.TrafficPolicy_PortTrafficPolicy
+	for _, port := range service.Spec.Ports {
+		protocol := istioProtocol(port)
+		if protocol == "" {
+			continue
+		}
+
+		number := uint32(port.TargetPort.IntVal)
+		if number == 0 {
+			number = uint32(port.Port)
+		}
+		sePort := &networkingapiv1beta1.Port{
+			Number:   number,
+			Protocol: protocol,
+			Name:     fmt.Sprintf("%s-%d", strings.ToLower(protocol), number),
+		}
+
+		if h.externalLinkTLSOrigination && protocol == "HTTP" {
+			sePort.TargetPort = tlsOriginationPort
+			tlsPorts = append(tlsPorts, &networkingapiv1beta1.TrafficPolicy_PortTrafficPolicy{
+				Port: &networkingapiv1beta1.PortSelector{
+					Number: number,
+				},
+				Tls: &networkingapiv1beta1.ClientTLSSettings{
+					Mode: networkingapiv1beta1.ClientTLSSettings_SIMPLE,
+					Sni:  host,
+				},
+			})
+		}
+		serviceEntry.Spec.Ports = append(serviceEntry.Spec.Ports, sePort)
+	}
+
+	if len(serviceEntry.Spec.Ports) == 0 {
+		return nil
+	}
+
+	result := []kclient.Object{serviceEntry}
+	if len(tlsPorts) > 0 {
+		result = append(result, &networkingv1beta1.DestinationRule{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      service.Name,
+				Namespace: service.Namespace,
+				Labels: map[string]string{
+					acornManagedLabel: "true",
+				},
+			},
+			Spec: networkingapiv1beta1.DestinationRule{
+				Host: host,
+				TrafficPolicy: &networkingapiv1beta1.TrafficPolicy{
+					PortLevelSettings: tlsPorts,
+				},
+				ExportTo: []string{"."},
+			},
+		})
+	}
+	return result
+}
+
+// istioProtocol returns the Istio protocol of a Service port, or an empty string if Istio can't handle it
+func istioProtocol(port corev1.ServicePort) string {
+	if port.AppProtocol != nil {
+		switch strings.ToUpper(*port.AppProtocol) {
+		case "HTTP", "HTTP2", "HTTPS", "GRPC", "TLS", "TCP":
+			return strings.ToUpper(*port.AppProtocol)
+		}
+	}
+
+	switch port.Protocol {
+	case corev1.ProtocolTCP, "":
+		return "TCP"
+	default:
+		// Istio doesn't proxy UDP or SCTP
+		return ""
+	}
+}
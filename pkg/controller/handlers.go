@@ -1,10 +1,12 @@
 package controller
 
 import (
-	"fmt"
-	"strings"
+	"strconv"
 	"time"
 
+	"github.com/acorn-io/acorn-istio-plugin/pkg/hostname"
+	"github.com/acorn-io/acorn-istio-plugin/pkg/metrics"
+	"github.com/acorn-io/baaah/pkg/backend"
 	"github.com/acorn-io/baaah/pkg/name"
 	"github.com/acorn-io/baaah/pkg/router"
 	"github.com/sirupsen/logrus"
@@ -14,17 +16,20 @@ import (
 	networkingv1beta1 "istio.io/client-go/pkg/apis/networking/v1beta1"
 	securityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
 	corev1 "k8s.io/api/core/v1"
-	netv1 "k8s.io/api/networking/v1"
-	apierror "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 const (
 	systemIngress   = "acorn-dns-ingress"
 	systemNamespace = "acorn-system"
 
-	injectionLabel            = "istio-injection"
+	injectionLabel = "istio-injection"
+	// injectionAddedAnnotation records that the plugin added the injection label, so that only these labels are
+	// removed by the uninstall subcommand
+	injectionAddedAnnotation  = "acorn.io/istio-plugin-injection-added"
 	proxySidecarContainerName = "istio-proxy"
 
 	acornAppNameLabel       = "acorn.io/app-name"
@@ -36,12 +41,38 @@ const (
 type Handler struct {
 	client                     kubernetes.Interface
 	debugImage                 string
+	shutdownCommand            []string
 	allowTrafficFromNamespaces string
+	localTrafficSourceCIDRs    []string
+	recorder                   record.EventRecorder
+	orphanSweepInterval        time.Duration
+	sidecarShutdownDeadline    time.Duration
+	deleteStuckJobPods         bool
+	proxyConcurrency           int
+	proxyImageType             string
+	scopeSidecarEgress         bool
+	sidecarEgressNamespaces    []string
+	externalLinkTLSOrigination bool
+	resolver                   hostname.Resolver
+	egressLockdown             bool
+	egressHintInterval         time.Duration
+	blockedConnections         *blockedConnections
+	trigger                    backend.Trigger
+	driftedObjects             *driftedObjects
+	pendingChanges             *pendingChanges
+	reportedWarnings           *reportedWarnings
+	linkTargets                *linkTargets
+	projects                   projectFilter
+	appInstances               bool
 }
 
-// AddLabels adds the "istio-injection: enabled" label on every Acorn project namespace
-func AddLabels(req router.Request, resp router.Response) error {
+// AddLabels adds the "istio-injection: enabled" label on every Acorn project namespace enrolled in the mesh, and
+// records that it did with an annotation. Labels that were set manually are left alone.
+func (h Handler) AddLabels(req router.Request, resp router.Response) error {
 	projectNamespace := req.Object.(*corev1.Namespace)
+	if !h.projects.enrolled(projectNamespace) {
+		return nil
+	}
 
 	if projectNamespace.Labels == nil {
 		projectNamespace.Labels = map[string]string{}
@@ -53,53 +84,11 @@ func AddLabels(req router.Request, resp router.Response) error {
 
 	logrus.Infof("Updating project %v to add istio-injection label", projectNamespace.Name)
 	projectNamespace.Labels[injectionLabel] = "enabled"
-	if err := req.Client.Update(req.Ctx, projectNamespace); err != nil {
-		return err
+	if projectNamespace.Annotations == nil {
+		projectNamespace.Annotations = map[string]string{}
 	}
-
-	return nil
-}
-
-// KillIstioSidecar kills the Istio sidecar on every pod that corresponds to an Acorn job, once the job is complete
-func (h Handler) KillIstioSidecar(req router.Request, resp router.Response) error {
-	pod := req.Object.(*corev1.Pod)
-
-	if _, ok := pod.Labels["acorn.io/job-name"]; !ok {
-		return nil // pod doesn't belong to the job, so skip it
-	}
-
-	foundSidecar := false
-	for _, containerStatus := range pod.Status.ContainerStatuses {
-		if containerStatus.Name != proxySidecarContainerName && containerStatus.State.Terminated == nil {
-			return nil
-		}
-		if containerStatus.Name == proxySidecarContainerName {
-			foundSidecar = true
-		}
-	}
-
-	if !foundSidecar {
-		return nil
-	}
-
-	// If pod is already configured with ephemeral container, skip
-	if len(pod.Spec.EphemeralContainers) > 0 {
-		return nil
-	}
-
-	logrus.Infof("Launching ephemeral container to kill pod %v/%v sidecar", pod.Namespace, pod.Name)
-	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, corev1.EphemeralContainer{
-		TargetContainerName: proxySidecarContainerName,
-		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
-			Name:            "shutdown-sidecar",
-			Image:           h.debugImage,
-			ImagePullPolicy: corev1.PullAlways,
-			Command: []string{
-				"curl", "-X", "POST", "http://localhost:15000/quitquitquit",
-			},
-		},
-	})
-	if _, err := h.client.CoreV1().Pods(pod.Namespace).UpdateEphemeralContainers(req.Ctx, pod.Name, pod, metav1.UpdateOptions{}); err != nil {
+	projectNamespace.Annotations[injectionAddedAnnotation] = "true"
+	if err := req.Client.Update(req.Ctx, projectNamespace); err != nil {
 		return err
 	}
 
@@ -132,129 +121,61 @@ func (h Handler) PoliciesForApp(req router.Request, resp router.Response) error
 	return nil
 }
 
-// PoliciesForIngress creates Istio an PeerAuthentication for each Ingress resource
-// created by Acorn. The PeerAuthentication sets mTLS to PERMISSIVE mode on the ports exposed by the
-// Ingresses so that the containers will accept traffic coming from outside the Istio mesh.
-func PoliciesForIngress(req router.Request, resp router.Response) error {
-	ingress := req.Object.(*netv1.Ingress)
+// PoliciesForService creates an Istio AuthorizationPolicy for each LoadBalancer or NodePort Service created by
+// Acorn that uses the Local external traffic policy. Since the client IP is preserved for those Services, plaintext
+// traffic on their ports is restricted to the Service's source ranges (or the configured default CIDRs).
+// The PERMISSIVE PeerAuthentication for these ports is created by PoliciesForWorkloads.
+func (h Handler) PoliciesForService(req router.Request, resp router.Response) error {
+	service := req.Object.(*corev1.Service)
+	emptySelector := h.warnings(req, "EmptySelector")
 
-	// Don't process the Ingress resource created for Acorn DNS, since it doesn't refer to any pods
-	if ingress.Name == systemIngress && ingress.Namespace == systemNamespace {
+	// We only care about LoadBalancer and NodePort services that were created for published TCP/UDP ports
+	if !isPublishedService(service) {
+		emptySelector.flush()
 		return nil
 	}
 
-	appName := ingress.Labels[acornAppNameLabel]
-	projectName := ingress.Labels[acornProjectNameLabel]
-
-	// Create a mapping of k8s Service names to published port names/numbers
-	svcNameToPorts := make(map[string][]netv1.ServiceBackendPort)
-	for _, rule := range ingress.Spec.Rules {
-		for _, path := range rule.HTTP.Paths {
-			svcName := path.Backend.Service.Name
-			port := path.Backend.Service.Port
-			svcNameToPorts[svcName] = append(svcNameToPorts[svcName], port)
-		}
+	if len(service.Spec.Selector) == 0 {
+		h.refuseEmptySelector(emptySelector, service, "service", service)
+		emptySelector.flush()
+		return nil
 	}
 
-	for svcName, ports := range svcNameToPorts {
-		// Get the Service from k8s
-		svc := corev1.Service{}
-		err := req.Get(&svc, ingress.Namespace, svcName)
-		if err != nil {
-			// service doesn't exist yet, so retry in 3 seconds
-			resp.RetryAfter(3 * time.Second)
-		}
-
-		// This service is either a normal ClusterIP service or an ExternalName service which
-		// points to a service in a different namespace (if there are Acorn links involved).
-		// If it's an ExternalName, we need to get the service to which it points.
-		if svc.Spec.Type == corev1.ServiceTypeExternalName {
-			externalName := svc.Spec.ExternalName
-
-			// The ExternalName is in the format <service name>.<namespace>.svc.<cluster domain>
-			svcName, rest, ok := strings.Cut(externalName, ".")
-			if !ok {
-				return fmt.Errorf("failed to parse ExternalName '%s' of svc '%s'", externalName, svc.Name)
-			}
-			svcNamespace, _, ok := strings.Cut(rest, ".")
-			if !ok {
-				return fmt.Errorf("failed to parse ExternalName '%s' of svc '%s'", externalName, svc.Name)
-			}
-
-			svc = corev1.Service{}
-			if err = req.Get(&svc, svcNamespace, svcName); err != nil {
-				if apierror.IsNotFound(err) {
-					return fmt.Errorf("failed to find service '%s', targeted by ExternalName '%s'", svcName, externalName)
-				}
-				return err
-			}
-		}
-
-		policyName := name.SafeConcatName(projectName, appName, ingress.Name, svcName)
-
-		// Find all published port numbers
-		portsMTLS := make(map[uint32]*v1beta1.PeerAuthentication_MutualTLS, len(ports))
-		for _, port := range ports {
-			// Try to map this ingress port to a port on the service
-			for _, svcPort := range svc.Spec.Ports {
-				if (svcPort.Name != "" && svcPort.Name == port.Name) || svcPort.Port == port.Number {
-					targetPort := svcPort.TargetPort
-					portsMTLS[uint32(targetPort.IntVal)] = &v1beta1.PeerAuthentication_MutualTLS{
-						Mode: v1beta1.PeerAuthentication_MutualTLS_PERMISSIVE,
-					}
-				}
-			}
-		}
-
-		// Create a permissive PeerAuthentication for pods targeted by the service
-		peerAuth := securityv1beta1.PeerAuthentication{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      policyName,
-				Namespace: svc.Namespace,
-				Labels: map[string]string{
-					acornManagedLabel: "true",
-				},
-			},
-			Spec: v1beta1.PeerAuthentication{
-				Selector: &typev1beta1.WorkloadSelector{
-					MatchLabels: svc.Spec.Selector,
-				},
-				PortLevelMtls: portsMTLS,
-			},
-		}
+	appName := service.Labels[acornAppNameLabel]
+	projectName := service.Labels[acornProjectNameLabel]
+	containerName := service.Labels[acornContainerNameLabel]
 
-		resp.Objects(&peerAuth)
+	policyName := name.SafeConcatName(projectName, appName, service.Name, containerName)
+	if authPolicy := h.sourceRestrictionForService(service, policyName); authPolicy != nil {
+		resp.Objects(authPolicy)
 	}
-
+	emptySelector.flush()
 	return nil
 }
 
-// PoliciesForService creates an Istio PeerAuthentication for each LoadBalancer Service
-// created by Acorn. The PeerAuthentication sets mTLS to PERMISSIVE mode on the ports targeted by the Service
-// so that the containers will accept traffic coming from outside the Istio mesh.
-func PoliciesForService(req router.Request, resp router.Response) error {
-	service := req.Object.(*corev1.Service)
-
-	// We only care about LoadBalancer services that were created for published TCP/UDP ports
-	if service.Spec.Type != corev1.ServiceTypeLoadBalancer {
+// sourceRestrictionForService returns an AuthorizationPolicy that denies plaintext traffic to the Service's
+// target ports unless it comes from an allowed CIDR. It returns nil if the Service doesn't preserve the client IP
+// or if there are no CIDRs to restrict to.
+func (h Handler) sourceRestrictionForService(service *corev1.Service, policyName string) *securityv1beta1.AuthorizationPolicy {
+	if service.Spec.ExternalTrafficPolicy != corev1.ServiceExternalTrafficPolicyTypeLocal {
 		return nil
 	}
 
-	appName := service.Labels[acornAppNameLabel]
-	projectName := service.Labels[acornProjectNameLabel]
-	containerName := service.Labels[acornContainerNameLabel]
+	cidrs := service.Spec.LoadBalancerSourceRanges
+	if len(cidrs) == 0 {
+		cidrs = h.localTrafficSourceCIDRs
+	}
+	if len(cidrs) == 0 {
+		return nil
+	}
 
-	portsMTLS := make(map[uint32]*v1beta1.PeerAuthentication_MutualTLS, len(service.Spec.Ports))
+	ports := make([]string, 0, len(service.Spec.Ports))
 	for _, port := range service.Spec.Ports {
-		portsMTLS[uint32(port.TargetPort.IntVal)] = &v1beta1.PeerAuthentication_MutualTLS{
-			Mode: v1beta1.PeerAuthentication_MutualTLS_PERMISSIVE,
-		}
+		ports = append(ports, strconv.Itoa(int(port.TargetPort.IntVal)))
 	}
 
-	policyName := name.SafeConcatName(projectName, appName, service.Name, containerName)
-
-	// Create a permissive PeerAuthentication for pods targeted by the service
-	peerAuth := securityv1beta1.PeerAuthentication{
+	// Mesh traffic always carries a principal, so only plaintext traffic from outside the allowed CIDRs is denied
+	return &securityv1beta1.AuthorizationPolicy{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      policyName,
 			Namespace: service.Namespace,
@@ -262,28 +183,57 @@ func PoliciesForService(req router.Request, resp router.Response) error {
 				acornManagedLabel: "true",
 			},
 		},
-		Spec: v1beta1.PeerAuthentication{
+		Spec: v1beta1.AuthorizationPolicy{
 			Selector: &typev1beta1.WorkloadSelector{
 				MatchLabels: service.Spec.Selector,
 			},
-			PortLevelMtls: portsMTLS,
+			Action: v1beta1.AuthorizationPolicy_DENY,
+			Rules: []*v1beta1.Rule{{
+				From: []*v1beta1.Rule_From{{
+					Source: &v1beta1.Source{
+						NotPrincipals: []string{"*"},
+						NotIpBlocks:   cidrs,
+					},
+				}},
+				To: []*v1beta1.Rule_To{{
+					Operation: &v1beta1.Operation{
+						Ports: ports,
+					},
+				}},
+			}},
 		},
 	}
+}
 
-	resp.Objects(&peerAuth)
-	return nil
+// refuseEmptySelector records that no port-level policy was generated for the pods behind svc, because a
+// PeerAuthentication without a workload selector would apply to the entire namespace. It is reported, and counted,
+// once until a reconcile no longer finds it.
+func (h Handler) refuseEmptySelector(emptySelector *warnings, source kclient.Object, sourceKind string, svc *corev1.Service) {
+	emptySelector.add(sourceKind+" "+toKey(source.GetNamespace(), source.GetName())+" "+toKey(svc.Namespace, svc.Name), func() {
+		logrus.Warnf("Refusing to create PERMISSIVE policy for service %v/%v because it has no selector", svc.Namespace, svc.Name)
+		h.eventf(source, corev1.EventTypeWarning, "EmptySelector",
+			"Refusing to create PERMISSIVE policy for service %s/%s because it has no selector", svc.Namespace, svc.Name)
+		metrics.RefusedPolicies.WithLabelValues(sourceKind).Inc()
+	})
 }
 
 // VirtualServiceForLink creates an Istio VirtualService for each link between Acorn apps.
 // This is in order to make mTLS work between workloads across namespaces.
-func VirtualServiceForLink(req router.Request, resp router.Response) error {
+// Links to hosts outside the cluster also get a ServiceEntry, see objectsForExternalLink.
+func (h Handler) VirtualServiceForLink(req router.Request, resp router.Response) error {
 	service := req.Object.(*corev1.Service)
+	target := h.resolver.Resolve(service.Spec.ExternalName)
 
 	// The link label shouldn't be present on any non-ExternalName type Services, but check anyway
 	if service.Spec.Type != corev1.ServiceTypeExternalName || len(service.Spec.Ports) == 0 {
 		return nil
 	}
 
+	if target.Kind == hostname.Invalid {
+		logrus.Warnf("Skipping link %s because its ExternalName %q is not a valid hostname", req.Key, service.Spec.ExternalName)
+		return nil
+	}
+
 	virtualService := networkingv1beta1.VirtualService{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      service.Name,
@@ -297,7 +247,7 @@ func VirtualServiceForLink(req router.Request, resp router.Response) error {
 			Http: []*networkingapiv1beta1.HTTPRoute{{
 				Route: []*networkingapiv1beta1.HTTPRouteDestination{{
 					Destination: &networkingapiv1beta1.Destination{
-						Host: service.Spec.ExternalName,
+						Host: target.Hostname,
 						Port: &networkingapiv1beta1.PortSelector{
 							Number: uint32(service.Spec.Ports[0].TargetPort.IntVal),
 						},
@@ -308,9 +258,15 @@ func VirtualServiceForLink(req router.Request, resp router.Response) error {
 	}
 
 	resp.Objects(&virtualService)
+	if target.Kind == hostname.External {
+		resp.Objects(h.objectsForExternalLink(service, target.Hostname)...)
+	}
 	return nil
 }
 
-func DoNothing(req router.Request, resp router.Response) error {
-	return nil
+func toKey(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
 }
@@ -1,13 +1,19 @@
 package controller
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/acorn-io/acorn-istio-plugin/pkg/scheme"
 	"github.com/acorn-io/baaah/pkg/router/tester"
 	"github.com/stretchr/testify/assert"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
 )
 
 func TestHandler_AddLabels(t *testing.T) {
@@ -18,11 +24,12 @@ func TestHandler_AddLabels(t *testing.T) {
 
 	req := tester.NewRequest(t, harness.Scheme, input, harness.Existing...)
 
-	if err := AddLabels(req, nil); err != nil {
+	if err := (Handler{}).AddLabels(req, nil); err != nil {
 		t.Fatal(err)
 	}
 
 	assert.Equal(t, "enabled", input.GetLabels()[injectionLabel])
+	assert.Equal(t, "true", input.GetAnnotations()[injectionAddedAnnotation])
 }
 
 func TestHandler_KillIstioSidecar(t *testing.T) {
@@ -32,13 +39,14 @@ func TestHandler_KillIstioSidecar(t *testing.T) {
 	}
 
 	req := tester.NewRequest(t, harness.Scheme, input, harness.Existing...)
+	resp := &tester.Response{}
 
 	h := Handler{
 		client:     fake.NewSimpleClientset(input),
 		debugImage: "foo",
 	}
 
-	if err = h.KillIstioSidecar(req, nil); err != nil {
+	if err = h.KillIstioSidecar(req, resp); err != nil {
 		t.Fatal(err)
 	}
 
@@ -55,6 +63,154 @@ func TestHandler_KillIstioSidecar(t *testing.T) {
 	}
 
 	assert.Equal(t, expected, input.(*corev1.Pod).Spec.EphemeralContainers[0])
+	assert.Equal(t, shutdownInitialBackoff, resp.Delay)
+}
+
+func TestHandler_KillIstioSidecarRetry(t *testing.T) {
+	harness, input, err := tester.FromDir(scheme.Scheme, "testdata/killsidecar-retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setNow(t, "2023-01-25T18:58:00Z")
+	req := tester.NewRequest(t, harness.Scheme, input, harness.Existing...)
+	resp := &tester.Response{}
+
+	h := Handler{
+		client:                  fake.NewSimpleClientset(input),
+		debugImage:              "foo",
+		sidecarShutdownDeadline: 5 * time.Minute,
+	}
+
+	if err = h.KillIstioSidecar(req, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	containers := input.(*corev1.Pod).Spec.EphemeralContainers
+	assert.Len(t, containers, 3)
+	assert.Equal(t, "shutdown-sidecar-1", containers[2].Name)
+	assert.Equal(t, 2*shutdownInitialBackoff, resp.Delay)
+}
+
+func TestHandler_KillIstioSidecarEscalate(t *testing.T) {
+	harness, input, err := tester.FromDir(scheme.Scheme, "testdata/killsidecar-escalate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setNow(t, "2023-01-25T19:10:00Z")
+	client := fake.NewSimpleClientset(input)
+	recorder := record.NewFakeRecorder(2)
+	h := Handler{
+		client:                  client,
+		debugImage:              "foo",
+		recorder:                recorder,
+		sidecarShutdownDeadline: 5 * time.Minute,
+		deleteStuckJobPods:      true,
+	}
+
+	escalate := func(pod *corev1.Pod) *tester.Response {
+		resp := &tester.Response{}
+		if err := h.KillIstioSidecar(tester.NewRequest(t, harness.Scheme, pod, harness.Existing...), resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// The Job isn't complete, deleting the pod would make it start a replacement
+	resp := escalate(input.(*corev1.Pod))
+	assert.Len(t, input.(*corev1.Pod).Spec.EphemeralContainers, 2)
+	assert.Zero(t, resp.Delay)
+	assert.Equal(t, []string{"Warning SidecarShutdownFailed Istio sidecar is still running 5m0s after the job finished, after 1 shutdown attempts"},
+		drainEvents(recorder))
+
+	pod, err := client.CoreV1().Pods("test").Get(context.Background(), "test", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "true", pod.Annotations[shutdownEscalatedAnnotation])
+
+	// The failure is only reported once, and the pod is deleted once the Job is complete
+	job := harness.Existing[0].(*batchv1.Job)
+	job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{
+		Type:   batchv1.JobComplete,
+		Status: corev1.ConditionTrue,
+	})
+	escalate(pod)
+	assert.Equal(t, []string{"Normal DeletedStuckPod Deleted pod because its job succeeded but its Istio sidecar could not be shut down"},
+		drainEvents(recorder))
+
+	_, err = client.CoreV1().Pods("test").Get(context.Background(), "test", metav1.GetOptions{})
+	assert.True(t, apierror.IsNotFound(err), "expected the pod to be deleted, got %v", err)
+}
+
+func TestHandler_KillIstioSidecarOnFailure(t *testing.T) {
+	harness, input, err := tester.FromDir(scheme.Scheme, "testdata/killsidecar-onfailure")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler{
+		client:     fake.NewSimpleClientset(input),
+		debugImage: "foo",
+	}
+
+	// The container is about to be restarted, so the sidecar must keep running
+	req := tester.NewRequest(t, harness.Scheme, input, harness.Existing...)
+	if err = h.KillIstioSidecar(req, &tester.Response{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, input.(*corev1.Pod).Spec.EphemeralContainers)
+
+	// Once the Job reached its backoff limit, nothing will restart the container
+	job := harness.Existing[0].(*batchv1.Job)
+	job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{
+		Type:   batchv1.JobFailed,
+		Status: corev1.ConditionTrue,
+		Reason: "BackoffLimitExceeded",
+	})
+	req = tester.NewRequest(t, harness.Scheme, input, harness.Existing...)
+	if err = h.KillIstioSidecar(req, &tester.Response{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, input.(*corev1.Pod).Spec.EphemeralContainers, 1)
+}
+
+func TestHandler_KillJobSidecars(t *testing.T) {
+	harness, input, err := tester.FromDir(scheme.Scheme, "testdata/killjobsidecars")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setNow(t, "2023-01-25T18:58:00Z")
+	req := tester.NewRequest(t, harness.Scheme, input, harness.Existing...)
+	resp := &tester.Response{}
+
+	client := fake.NewSimpleClientset()
+	for _, obj := range harness.Existing {
+		if err := client.Tracker().Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := Handler{
+		client:                  client,
+		debugImage:              "foo",
+		sidecarShutdownDeadline: 5 * time.Minute,
+	}
+
+	if err = h.KillJobSidecars(req, resp); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, shutdownInitialBackoff, resp.Delay)
+
+	// Only the pod of this Job whose sidecar is still running gets a shutdown container
+	for podName, attempts := range map[string]int{"foo-x7k2p": 1, "foo-9qzld": 0, "bar-4hm8s": 0} {
+		pod, err := client.CoreV1().Pods("test").Get(context.Background(), podName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, pod.Spec.EphemeralContainers, attempts, podName)
+	}
 }
 
 func TestHandler_PoliciesForApp(t *testing.T) {
@@ -64,18 +220,119 @@ func TestHandler_PoliciesForApp(t *testing.T) {
 	tester.DefaultTest(t, scheme.Scheme, "testdata/app", h.PoliciesForApp)
 }
 
-func TestHandler_PoliciesForIngress(t *testing.T) {
-	tester.DefaultTest(t, scheme.Scheme, "testdata/ingress", PoliciesForIngress)
+func TestHandler_ProxyConfigForApp(t *testing.T) {
+	recorder := record.NewFakeRecorder(2)
+	h := Handler{
+		recorder:         recorder,
+		proxyConcurrency: 2,
+		proxyImageType:   "distroless",
+		reportedWarnings: newReportedWarnings(),
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/proxyconfig", h.ProxyConfigForApp)
+
+	// The invalid image type is replaced by the default
+	assert.Len(t, recorder.Events, 1)
+
+	// and only reported once while it doesn't change
+	tester.DefaultTest(t, scheme.Scheme, "testdata/proxyconfig", h.ProxyConfigForApp)
+	assert.Len(t, recorder.Events, 1)
+}
+
+func TestHandler_SidecarForApp(t *testing.T) {
+	h := Handler{
+		scopeSidecarEgress:      true,
+		sidecarEgressNamespaces: []string{"monitoring"},
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/sidecar", h.SidecarForApp)
+}
+
+func TestHandler_SidecarForAppLockdown(t *testing.T) {
+	recorder := record.NewFakeRecorder(2)
+	h := Handler{
+		recorder:         recorder,
+		reportedWarnings: newReportedWarnings(),
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/sidecar-lockdown", h.SidecarForApp)
+
+	// The invalid host is reported and skipped
+	assert.Len(t, recorder.Events, 1)
+
+	// and only reported once while the annotation doesn't change
+	tester.DefaultTest(t, scheme.Scheme, "testdata/sidecar-lockdown", h.SidecarForApp)
+	assert.Len(t, recorder.Events, 1)
 }
 
-func TestHandler_PoliciesForIngressExternalName(t *testing.T) {
-	tester.DefaultTest(t, scheme.Scheme, "testdata/externalname", PoliciesForIngress)
+func TestHandler_PoliciesForWorkloadsIngress(t *testing.T) {
+	clusterTest(t, "testdata/ingress", Handler{}.PoliciesForWorkloads)
 }
 
-func TestHandler_PoliciesForService(t *testing.T) {
-	tester.DefaultTest(t, scheme.Scheme, "testdata/service", PoliciesForService)
+func TestHandler_PoliciesForWorkloadsExternalName(t *testing.T) {
+	h := Handler{linkTargets: newLinkTargets()}
+	h.linkTargets.update("other-namespace/service-7777", linkTarget{namespace: "other-namespace", target: "my-app-namespace"})
+	clusterTest(t, "testdata/externalname", h.PoliciesForWorkloads)
+}
+
+func TestHandler_PoliciesForWorkloadsLinkTargetNotFound(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	h := Handler{
+		recorder:         recorder,
+		linkTargets:      newLinkTargets(),
+		reportedWarnings: newReportedWarnings(),
+	}
+	h.linkTargets.update("other-namespace/service-7777", linkTarget{namespace: "other-namespace", target: "my-app-namespace"})
+	h.linkTargets.update("other-namespace/missing", linkTarget{namespace: "other-namespace", target: "my-app-namespace"})
+
+	// The Ingress of the missing Service is skipped, the other ports are still PERMISSIVE, and the warning is only
+	// reported once
+	clusterTest(t, "testdata/link-target-not-found", h.PoliciesForWorkloads)
+	clusterTest(t, "testdata/link-target-not-found", h.PoliciesForWorkloads)
+	assert.Equal(t, []string{
+		"Warning LinkTargetNotFound Service my-app-namespace/missing, targeted by ExternalName missing.my-app-namespace.svc.cluster.local, doesn't exist",
+	}, drainEvents(recorder))
+}
+
+func TestHandler_PoliciesForWorkloadsService(t *testing.T) {
+	clusterTest(t, "testdata/service", Handler{}.PoliciesForWorkloads)
+}
+
+func TestHandler_PoliciesForWorkloadsMerged(t *testing.T) {
+	clusterTest(t, "testdata/workloads", Handler{}.PoliciesForWorkloads)
+}
+
+func TestHandler_PoliciesForWorkloadsAppInstance(t *testing.T) {
+	clusterTest(t, "testdata/appinstance", Handler{appInstances: true}.PoliciesForWorkloads)
+}
+
+func TestHandler_PoliciesForServiceNodePort(t *testing.T) {
+	h := Handler{
+		localTrafficSourceCIDRs: []string{"10.0.0.0/8"},
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/nodeport", h.PoliciesForService)
+}
+
+func TestHandler_PoliciesForServiceEmptySelector(t *testing.T) {
+	recorder := record.NewFakeRecorder(2)
+	h := Handler{
+		recorder:         recorder,
+		reportedWarnings: newReportedWarnings(),
+	}
+
+	resp := tester.DefaultTest(t, scheme.Scheme, "testdata/noselector", h.PoliciesForService)
+	assert.Empty(t, resp.Collected)
+	assert.Len(t, recorder.Events, 1)
+
+	// The refusal is only reported again once it was resolved
+	tester.DefaultTest(t, scheme.Scheme, "testdata/noselector", h.PoliciesForService)
+	assert.Len(t, recorder.Events, 1)
 }
 
 func TestHandler_VirtualServiceForLink(t *testing.T) {
-	tester.DefaultTest(t, scheme.Scheme, "testdata/link", VirtualServiceForLink)
+	tester.DefaultTest(t, scheme.Scheme, "testdata/link", Handler{}.VirtualServiceForLink)
+}
+
+func TestHandler_VirtualServiceForExternalLink(t *testing.T) {
+	h := Handler{
+		externalLinkTLSOrigination: true,
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/link-external", h.VirtualServiceForLink)
 }
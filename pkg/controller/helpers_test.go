@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/scheme"
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/acorn-io/baaah/pkg/router/tester"
+	"github.com/stretchr/testify/assert"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+)
+
+// clusterTest is like tester.DefaultTest, but the request is backed by a client that is able to list
+// objects across all namespaces, which the baaah tester client doesn't support.
+func clusterTest(t *testing.T, path string, handler router.HandlerFunc) *tester.Response {
+	t.Helper()
+
+	harness, input, err := tester.FromDir(scheme.Scheme, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := tester.NewRequest(t, scheme.Scheme, input, harness.Existing...)
+	req.Client = fake.NewClientBuilder().
+		WithScheme(scheme.Scheme).
+		WithObjects(append(harness.Existing, input.DeepCopyObject().(kclient.Object))...).
+		Build()
+
+	resp := &tester.Response{}
+	if err := handler(req, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, harness.ExpectedDelay, resp.Delay)
+	assert.Equal(t, toYAMLByKey(t, harness.ExpectedOutput), toYAMLByKey(t, resp.Collected))
+	return resp
+}
+
+func toYAMLByKey(t *testing.T, objs []kclient.Object) map[string]string {
+	t.Helper()
+
+	result := map[string]string{}
+	for _, obj := range objs {
+		gvk, err := apiutil.GVKForObject(obj, scheme.Scheme)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj.GetObjectKind().SetGroupVersionKind(gvk)
+
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result[gvk.Kind+" "+obj.GetNamespace()+"/"+obj.GetName()] = string(data)
+	}
+	return result
+}
+
+// setNow fixes the current time seen by the handlers for the duration of the test
+func setNow(t *testing.T, timestamp string) {
+	t.Helper()
+
+	fixed, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = func() time.Time {
+		return fixed
+	}
+	t.Cleanup(func() {
+		now = time.Now
+	})
+}
@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/hostname"
+	"github.com/acorn-io/baaah/pkg/router"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// linkTarget is the namespace of an Acorn link and the namespace of the Service that it targets
+type linkTarget struct {
+	namespace string
+	target    string
+}
+
+// linkTargets remembers the namespace targeted by each Acorn link to another namespace of the cluster, so that an app
+// namespace finds the namespaces linking to it without listing every link of the cluster. A nil *linkTargets is valid
+// and knows no links.
+type linkTargets struct {
+	lock  sync.Mutex
+	links map[string]linkTarget
+}
+
+func newLinkTargets() *linkTargets {
+	return &linkTargets{
+		links: map[string]linkTarget{},
+	}
+}
+
+// update records the link, an empty target forgetting it, and returns the namespace that it targeted before
+func (l *linkTargets) update(key string, link linkTarget) string {
+	if l == nil {
+		return ""
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	previous := l.links[key].target
+	if link.target == "" {
+		delete(l.links, key)
+	} else {
+		l.links[key] = link
+	}
+	return previous
+}
+
+// linking returns the other namespaces that have a link to the namespace, sorted
+func (l *linkTargets) linking(namespace string) []string {
+	if l == nil {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	found := map[string]bool{}
+	for _, link := range l.links {
+		if link.target == namespace && link.namespace != namespace {
+			found[link.namespace] = true
+		}
+	}
+
+	result := make([]string, 0, len(found))
+	for linking := range found {
+		result = append(result, linking)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// TrackLinkTargets records the namespace targeted by each Acorn link, and triggers the app namespaces that a link
+// starts or stops targeting, so that PoliciesForWorkloads looks at the Ingresses of the namespaces linking to them.
+// It handles every Service, since a removed link, or one that lost its label, can't be selected.
+func (h Handler) TrackLinkTargets(req router.Request, resp router.Response) error {
+	link := linkTarget{namespace: req.Namespace}
+	if service, ok := req.Object.(*corev1.Service); ok && service.Spec.Type == corev1.ServiceTypeExternalName {
+		linkSelector, err := getLinkSelector()
+		if err != nil {
+			return err
+		}
+		target := h.resolver.Resolve(service.Spec.ExternalName)
+		if linkSelector.Matches(labels.Set(service.Labels)) && target.Kind == hostname.ClusterService &&
+			target.Namespace != service.Namespace {
+			link.target = target.Namespace
+		}
+	}
+
+	previous := h.linkTargets.update(req.Key, link)
+	if previous == link.target {
+		return nil
+	}
+	for _, namespace := range []string{previous, link.target} {
+		if namespace == "" {
+			continue
+		}
+		if err := h.trigger.Trigger(corev1.SchemeGroupVersion.WithKind("Namespace"), namespace, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/acorn-io/baaah/pkg/router/tester"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHandler_TrackLinkTargets(t *testing.T) {
+	trigger := &fakeTrigger{}
+	h := Handler{
+		trigger:     trigger,
+		linkTargets: newLinkTargets(),
+	}
+
+	link := func(externalName string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "db",
+				Namespace: "my-app-namespace",
+				Labels:    map[string]string{linkLabel: "db"},
+			},
+			Spec: corev1.ServiceSpec{
+				Type:         corev1.ServiceTypeExternalName,
+				ExternalName: externalName,
+			},
+		}
+	}
+	handle := func(service *corev1.Service) {
+		req := router.Request{
+			Namespace: "my-app-namespace",
+			Name:      "db",
+			Key:       "my-app-namespace/db",
+		}
+		if service != nil {
+			req.Object = service
+		}
+		if err := h.TrackLinkTargets(req, &tester.Response{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handle(link("db.db-namespace.svc.cluster.local"))
+	assert.Equal(t, []string{"my-app-namespace"}, h.linkTargets.linking("db-namespace"))
+	assert.Equal(t, []string{"Namespace db-namespace"}, trigger.triggered)
+
+	// Handling the link again doesn't trigger anything
+	handle(link("db.db-namespace.svc.cluster.local"))
+	assert.Len(t, trigger.triggered, 1)
+
+	// Both namespaces are triggered when the link moves
+	handle(link("db.other-db-namespace.svc.cluster.local"))
+	assert.Empty(t, h.linkTargets.linking("db-namespace"))
+	assert.Equal(t, []string{"my-app-namespace"}, h.linkTargets.linking("other-db-namespace"))
+	assert.Equal(t, []string{"Namespace db-namespace", "Namespace db-namespace", "Namespace other-db-namespace"}, trigger.triggered)
+
+	// and the target is triggered when the link is removed
+	handle(nil)
+	assert.Empty(t, h.linkTargets.linking("other-db-namespace"))
+	assert.Equal(t, "Namespace other-db-namespace", trigger.triggered[len(trigger.triggered)-1])
+
+	// Links to hosts outside the cluster and to the same namespace aren't recorded
+	handle(link("example.com"))
+	handle(link("db.my-app-namespace.svc.cluster.local"))
+	assert.Empty(t, h.linkTargets.linking("my-app-namespace"))
+	assert.Len(t, trigger.triggered, 4)
+}
@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/migrate"
+	"github.com/acorn-io/baaah/pkg/apply"
+	securityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// Migrations upgrade the objects generated by earlier versions of the plugin. They run at startup, before the
+// controller, and new ones are appended with the next version.
+var Migrations = []migrate.Migration{
+	{
+		Version:     1,
+		Description: "delete the AuthorizationPolicies that earlier versions generated for each app namespace",
+		Migrate: func(ctx context.Context, c kclient.Client) ([]string, error) {
+			return deleteAppliedObjects(ctx, c, &securityv1beta1.AuthorizationPolicyList{}, corev1.SchemeGroupVersion.WithKind("Namespace"))
+		},
+	},
+	{
+		Version:     2,
+		Description: "delete the PeerAuthentications that earlier versions generated for each Ingress, which are now merged per workload",
+		Migrate: func(ctx context.Context, c kclient.Client) ([]string, error) {
+			return deleteAppliedObjects(ctx, c, &securityv1beta1.PeerAuthenticationList{}, netv1.SchemeGroupVersion.WithKind("Ingress"))
+		},
+	},
+}
+
+// deleteAppliedObjects deletes the objects of the type of the list that the plugin's router applied for owners of the
+// given kind, as recorded by apply
+func deleteAppliedObjects(ctx context.Context, c kclient.Client, list kclient.ObjectList, owner schema.GroupVersionKind) ([]string, error) {
+	if err := c.List(ctx, list); err != nil {
+		return nil, err
+	}
+
+	var changes []string
+	err := meta.EachListItem(list, func(o runtime.Object) error {
+		obj := o.(kclient.Object)
+		annotations := obj.GetAnnotations()
+		if annotations[apply.LabelSubContext] != routerName || annotations[apply.LabelGVK] != owner.String() {
+			return nil
+		}
+
+		gvk, err := apiutil.GVKForObject(obj, c.Scheme())
+		if err != nil {
+			return err
+		}
+		if err := c.Delete(ctx, obj); err != nil && !apierror.IsNotFound(err) {
+			return err
+		}
+		changes = append(changes, fmt.Sprintf("deleted %s %s/%s of %s %s/%s", gvk.Kind, obj.GetNamespace(), obj.GetName(),
+			owner.Kind, annotations[apply.LabelNamespace], annotations[apply.LabelName]))
+		return nil
+	})
+	return changes, err
+}
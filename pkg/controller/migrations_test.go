@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/scheme"
+	"github.com/acorn-io/baaah/pkg/apply"
+	"github.com/stretchr/testify/assert"
+	securityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func appliedPeerAuthentication(name, subContext, ownerGVK string) *securityv1beta1.PeerAuthentication {
+	return &securityv1beta1.PeerAuthentication{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "my-app-namespace",
+			Annotations: map[string]string{
+				apply.LabelSubContext: subContext,
+				apply.LabelGVK:        ownerGVK,
+				apply.LabelNamespace:  "my-app-namespace",
+				apply.LabelName:       "my-ingress",
+			},
+		},
+	}
+}
+
+func TestMigrations_IngressPeerAuthentications(t *testing.T) {
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+		appliedPeerAuthentication("legacy", routerName, "networking.k8s.io/v1, Kind=Ingress"),
+		appliedPeerAuthentication("workload", routerName, "/v1, Kind=Namespace"),
+		appliedPeerAuthentication("other-controller", "other", "networking.k8s.io/v1, Kind=Ingress"),
+	).Build()
+
+	changes, err := Migrations[1].Migrate(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"deleted PeerAuthentication my-app-namespace/legacy of Ingress my-app-namespace/my-ingress"}, changes)
+
+	remaining := &securityv1beta1.PeerAuthenticationList{}
+	if err := c.List(context.Background(), remaining, kclient.InNamespace("my-app-namespace")); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, pa := range remaining.Items {
+		names = append(names, pa.Name)
+	}
+	assert.ElementsMatch(t, []string{"workload", "other-controller"}, names)
+}
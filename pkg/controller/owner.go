@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/sirupsen/logrus"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	ownerAPIVersionAnnotation = "acorn.io/istio-plugin-owner-api-version"
+	ownerKindAnnotation       = "acorn.io/istio-plugin-owner-kind"
+	ownerNamespaceAnnotation  = "acorn.io/istio-plugin-owner-namespace"
+	ownerNameAnnotation       = "acorn.io/istio-plugin-owner-name"
+)
+
+// TrackOwner is a middleware that records the object being handled as the owner of every object returned
+// by the handler. Unlike the ownership tracked by apply, these annotations can be followed across namespaces,
+// which lets SweepOrphans delete the objects once their owner is gone. It also records a hash of the generated spec
+// of each object, which DetectDrift compares with the actual spec.
+func TrackOwner(next router.Handler) router.Handler {
+	return router.HandlerFunc(func(req router.Request, resp router.Response) error {
+		return next.Handle(req, ownerTrackingResponse{
+			Response: resp,
+			owner:    req,
+		})
+	})
+}
+
+type ownerTrackingResponse struct {
+	router.Response
+	owner router.Request
+}
+
+func (o ownerTrackingResponse) Objects(objs ...kclient.Object) {
+	for _, obj := range objs {
+		annotations := obj.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[ownerAPIVersionAnnotation] = o.owner.GVK.GroupVersion().String()
+		annotations[ownerKindAnnotation] = o.owner.GVK.Kind
+		annotations[ownerNamespaceAnnotation] = o.owner.Namespace
+		annotations[ownerNameAnnotation] = o.owner.Name
+		if hash, err := specHash(obj); err == nil {
+			annotations[specHashAnnotation] = hash
+		} else {
+			logrus.Debugf("Failed to hash the spec of %s/%s, drift won't be detected: %v", obj.GetNamespace(), obj.GetName(), err)
+		}
+		obj.SetAnnotations(annotations)
+	}
+	o.Response.Objects(objs...)
+}
+
+// SweepOrphans deletes managed objects whose owner, as recorded by TrackOwner, no longer exists.
+// Objects whose owner still exists are checked again after the sweep interval.
+func (h Handler) SweepOrphans(req router.Request, resp router.Response) error {
+	annotations := req.Object.GetAnnotations()
+	if annotations[ownerKindAnnotation] == "" || annotations[ownerNameAnnotation] == "" {
+		return nil
+	}
+
+	gv, err := schema.ParseGroupVersion(annotations[ownerAPIVersionAnnotation])
+	if err != nil {
+		return err
+	}
+	ownerObj, err := req.Client.Scheme().New(gv.WithKind(annotations[ownerKindAnnotation]))
+	if err != nil {
+		return err
+	}
+	owner, ok := ownerObj.(kclient.Object)
+	if !ok {
+		return nil
+	}
+
+	if err := req.Get(owner, annotations[ownerNamespaceAnnotation], annotations[ownerNameAnnotation]); apierror.IsNotFound(err) {
+		logrus.Infof("Deleting %v %s because its owner %s %s no longer exists", req.GVK.Kind, req.Key,
+			annotations[ownerKindAnnotation], toKey(annotations[ownerNamespaceAnnotation], annotations[ownerNameAnnotation]))
+		if err := req.Client.Delete(req.Ctx, req.Object); err != nil && !apierror.IsNotFound(err) {
+			return err
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if h.orphanSweepInterval > 0 {
+		resp.RetryAfter(h.orphanSweepInterval)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/scheme"
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/acorn-io/baaah/pkg/router/tester"
+	"github.com/stretchr/testify/assert"
+	securityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestTrackOwner(t *testing.T) {
+	resp := &tester.Response{}
+	handler := TrackOwner(router.HandlerFunc(func(req router.Request, resp router.Response) error {
+		resp.Objects(&securityv1beta1.PeerAuthentication{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "policy",
+				Namespace: "my-app-namespace",
+			},
+		})
+		return nil
+	}))
+
+	if err := handler.Handle(router.Request{
+		GVK:       corev1.SchemeGroupVersion.WithKind("Service"),
+		Namespace: "other-namespace",
+		Name:      "linked-hostname",
+	}, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := specHash(&securityv1beta1.PeerAuthentication{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{
+		ownerAPIVersionAnnotation: "v1",
+		ownerKindAnnotation:       "Service",
+		ownerNamespaceAnnotation:  "other-namespace",
+		ownerNameAnnotation:       "linked-hostname",
+		specHashAnnotation:        hash,
+	}, resp.Collected[0].GetAnnotations())
+}
+
+func TestHandler_SweepOrphans(t *testing.T) {
+	orphan := ownedPeerAuthentication("orphan", "gone")
+	owned := ownedPeerAuthentication("owned", "my-app-namespace")
+	client := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+		orphan,
+		owned,
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "my-app-namespace"}},
+	).Build()
+
+	h := Handler{
+		orphanSweepInterval: time.Minute,
+	}
+
+	for _, obj := range []kclient.Object{orphan, owned} {
+		resp := &tester.Response{}
+		if err := h.SweepOrphans(router.Request{
+			Client:    client,
+			Object:    obj,
+			Ctx:       context.Background(),
+			Namespace: obj.GetNamespace(),
+			Name:      obj.GetName(),
+		}, resp); err != nil {
+			t.Fatal(err)
+		}
+
+		err := client.Get(context.Background(), router.Key(obj.GetNamespace(), obj.GetName()), &securityv1beta1.PeerAuthentication{})
+		if obj == orphan {
+			assert.True(t, apierror.IsNotFound(err), "expected the orphan to be deleted, got %v", err)
+			assert.Zero(t, resp.Delay)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, time.Minute, resp.Delay)
+		}
+	}
+}
+
+func ownedPeerAuthentication(name, ownerNamespace string) *securityv1beta1.PeerAuthentication {
+	return &securityv1beta1.PeerAuthentication{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "linked-namespace",
+			Labels: map[string]string{
+				acornManagedLabel: "true",
+			},
+			Annotations: map[string]string{
+				ownerAPIVersionAnnotation: "v1",
+				ownerKindAnnotation:       "Namespace",
+				ownerNameAnnotation:       ownerNamespace,
+			},
+		},
+	}
+}
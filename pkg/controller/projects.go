@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// namespaceMatcher matches namespaces either with a label selector or with globs of their name
+type namespaceMatcher struct {
+	selector labels.Selector
+	globs    []string
+}
+
+// parseNamespaceMatcher parses a label selector, such as "team in (a,b)", or a comma-separated list of name globs,
+// such as "team-*,dev". Values containing "=", "!", or parentheses are label selectors. An empty value returns nil.
+func parseNamespaceMatcher(s string) (*namespaceMatcher, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	if strings.ContainsAny(s, "=!()") {
+		selector, err := labels.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		return &namespaceMatcher{selector: selector}, nil
+	}
+
+	globs := splitList(s)
+	for _, glob := range globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", glob, err)
+		}
+	}
+	return &namespaceMatcher{globs: globs}, nil
+}
+
+func (m *namespaceMatcher) matches(ns *corev1.Namespace) bool {
+	if m.selector != nil {
+		return m.selector.Matches(labels.Set(ns.Labels))
+	}
+	for _, glob := range m.globs {
+		if ok, _ := path.Match(glob, ns.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// projectFilter decides which Acorn projects are enrolled in the mesh, from --include-projects and
+// --exclude-projects. A project is enrolled if it is included, which all projects are by default, and not excluded.
+type projectFilter struct {
+	include *namespaceMatcher
+	exclude *namespaceMatcher
+}
+
+func newProjectFilter(include, exclude string) (projectFilter, error) {
+	includeMatcher, err := parseNamespaceMatcher(include)
+	if err != nil {
+		return projectFilter{}, fmt.Errorf("invalid projects to include %q: %w", include, err)
+	}
+	excludeMatcher, err := parseNamespaceMatcher(exclude)
+	if err != nil {
+		return projectFilter{}, fmt.Errorf("invalid projects to exclude %q: %w", exclude, err)
+	}
+	return projectFilter{
+		include: includeMatcher,
+		exclude: excludeMatcher,
+	}, nil
+}
+
+func (f projectFilter) enrolled(project *corev1.Namespace) bool {
+	if f.include != nil && !f.include.matches(project) {
+		return false
+	}
+	return f.exclude == nil || !f.exclude.matches(project)
+}
+
+// projectEnrolled returns true if the namespace is an Acorn project enrolled in the mesh
+func (h Handler) projectEnrolled(project *corev1.Namespace) bool {
+	return projectSelector.Matches(labels.Set(project.Labels)) && h.projects.enrolled(project)
+}
+
+// appEnrolled returns true if the project of the app namespace is an Acorn project enrolled in the mesh. Reading the
+// project through the request makes changes to its labels, such as losing the acorn.io/project label, trigger the app
+// namespace again.
+func (h Handler) appEnrolled(req router.Request, appNamespace *corev1.Namespace) (bool, error) {
+	project := &corev1.Namespace{}
+	if err := req.Get(project, "", appNamespace.Labels[appNamespaceLabel]); apierror.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return h.projectEnrolled(project), nil
+}
+
+// EnrolledAppsOnly is a middleware that only calls the handler for the app namespaces whose project is an Acorn
+// project enrolled in the mesh. The objects generated for the other app namespaces are pruned, as long as no handler of the namespace
+// requeues it, since apply doesn't prune a response that has a delay and no objects. Periodic work on app namespaces,
+// such as ReportBlockedEgress, runs outside of the router for that reason.
+func (h Handler) EnrolledAppsOnly(next router.Handler) router.Handler {
+	return router.HandlerFunc(func(req router.Request, resp router.Response) error {
+		appNamespace := req.Object.(*corev1.Namespace)
+		enrolled, err := h.appEnrolled(req, appNamespace)
+		if err != nil {
+			return err
+		}
+		if !enrolled {
+			logrus.Debugf("Skipping app namespace %s, its project %s is not enrolled in the mesh", appNamespace.Name,
+				appNamespace.Labels[appNamespaceLabel])
+			return nil
+		}
+		return next.Handle(req, resp)
+	})
+}
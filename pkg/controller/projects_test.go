@@ -0,0 +1,163 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/acorn-io/baaah/pkg/router/tester"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProjectFilter(t *testing.T) {
+	teamA := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"mesh": "true"}}}
+	teamB := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b"}}
+	dev := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "dev", Labels: map[string]string{"mesh": "true"}}}
+
+	tests := []struct {
+		name     string
+		include  string
+		exclude  string
+		enrolled []string
+	}{
+		{
+			name:     "all projects",
+			enrolled: []string{"team-a", "team-b", "dev"},
+		},
+		{
+			name:     "included globs",
+			include:  "team-*, other",
+			enrolled: []string{"team-a", "team-b"},
+		},
+		{
+			name:     "included selector",
+			include:  "mesh=true",
+			enrolled: []string{"team-a", "dev"},
+		},
+		{
+			name:     "excluded from the included projects",
+			include:  "team-*",
+			exclude:  "team-b",
+			enrolled: []string{"team-a"},
+		},
+		{
+			name:     "excluded selector",
+			exclude:  "mesh in (true)",
+			enrolled: []string{"team-b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := newProjectFilter(tt.include, tt.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var enrolled []string
+			for _, ns := range []*corev1.Namespace{teamA, teamB, dev} {
+				if filter.enrolled(ns) {
+					enrolled = append(enrolled, ns.Name)
+				}
+			}
+			assert.Equal(t, tt.enrolled, enrolled)
+		})
+	}
+
+	_, err := newProjectFilter("team-[", "")
+	assert.Error(t, err)
+	_, err = newProjectFilter("", "mesh in (true")
+	assert.Error(t, err)
+}
+
+func TestHandler_EnrolledAppsOnly(t *testing.T) {
+	filter, err := newProjectFilter("mesh=true", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Handler{projects: filter}
+
+	handler := h.EnrolledAppsOnly(router.HandlerFunc(func(req router.Request, resp router.Response) error {
+		resp.Objects(peerAuthWithMode("strict", 0))
+		return nil
+	}))
+
+	for _, project := range []*corev1.Namespace{
+		{ObjectMeta: metav1.ObjectMeta{Name: "enrolled", Labels: map[string]string{"mesh": "true", "acorn.io/project": "true"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "not-enrolled", Labels: map[string]string{"acorn.io/project": "true"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "former-project", Labels: map[string]string{"mesh": "true"}}},
+	} {
+		app := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:   "my-app-namespace",
+			Labels: map[string]string{appNamespaceLabel: project.Name},
+		}}
+		resp := &tester.Response{}
+		if err := handler.Handle(namespaceRequest(app, project), resp); err != nil {
+			t.Fatal(err)
+		}
+		if project.Name == "enrolled" {
+			assert.Len(t, resp.Collected, 1)
+		} else {
+			assert.Empty(t, resp.Collected)
+		}
+	}
+}
+
+func TestHandler_NotEnrolledAppPruned(t *testing.T) {
+	tests := []struct {
+		name    string
+		exclude string
+		project *corev1.Namespace
+	}{
+		{
+			name:    "excluded project",
+			exclude: "excluded",
+			project: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "excluded",
+				Labels: map[string]string{"acorn.io/project": "true"},
+			}},
+		},
+		{
+			// Every project is enrolled, but this one lost the acorn.io/project label
+			name:    "former project",
+			project: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "acorn"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := newProjectFilter("", tt.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := Handler{
+				projects:           filter,
+				egressLockdown:     true,
+				egressHintInterval: time.Minute,
+			}
+
+			app := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "my-app-namespace",
+				Labels: map[string]string{appNamespaceLabel: tt.project.Name, appNameLabel: "my-app"},
+			}}
+
+			// apply skips pruning when the response of the namespace has a delay and no objects, so that the objects
+			// generated before the project was excluded would be kept
+			for _, handler := range []router.Handler{
+				router.HandlerFunc(h.Deenroll),
+				h.EnrolledAppsOnly(router.HandlerFunc(h.PoliciesForApp)),
+				h.EnrolledAppsOnly(router.HandlerFunc(h.PoliciesForWorkloads)),
+				h.EnrolledAppsOnly(router.HandlerFunc(h.ProxyConfigForApp)),
+				h.EnrolledAppsOnly(router.HandlerFunc(h.SidecarForApp)),
+			} {
+				resp := &tester.Response{}
+				if err := handler.Handle(namespaceRequest(app.DeepCopy(), tt.project), resp); err != nil {
+					t.Fatal(err)
+				}
+				assert.Empty(t, resp.Collected)
+				assert.Zero(t, resp.Delay)
+			}
+		})
+	}
+}
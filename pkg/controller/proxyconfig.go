@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"strconv"
+
+	"github.com/acorn-io/baaah/pkg/name"
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/sirupsen/logrus"
+	networkingapiv1beta1 "istio.io/api/networking/v1beta1"
+	networkingv1beta1 "istio.io/client-go/pkg/apis/networking/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// proxyConcurrencyAnnotation sets the number of Envoy worker threads for an app, "0" meaning one per CPU core
+	proxyConcurrencyAnnotation = "acorn.io/istio-proxy-concurrency"
+	// proxyImageTypeAnnotation sets the Istio proxy image type for an app: default, debug, or distroless
+	proxyImageTypeAnnotation = "acorn.io/istio-proxy-image-type"
+)
+
+var proxyImageTypes = map[string]bool{
+	"default":    true,
+	"debug":      true,
+	"distroless": true,
+}
+
+// ProxyConfigForApp creates an Istio ProxyConfig in each app's namespace from the proxy annotations of the namespace,
+// which Acorn propagates from the app, falling back to the cluster-wide defaults. No ProxyConfig is created when
+// neither the app nor the defaults set anything, so that the mesh config applies. A negative default concurrency
+// leaves it to the mesh config.
+func (h Handler) ProxyConfigForApp(req router.Request, resp router.Response) error {
+	appNamespace := req.Object.(*corev1.Namespace)
+
+	proxyConfig := &networkingv1beta1.ProxyConfig{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name.SafeConcatName(appNamespace.Name, "proxy"),
+			Namespace: appNamespace.Name,
+			Labels: map[string]string{
+				acornManagedLabel: "true",
+			},
+		},
+	}
+	spec := &proxyConfig.Spec
+	invalid := h.warnings(req, "InvalidProxyConfig")
+
+	concurrency := h.proxyConcurrency
+	if value, ok := appNamespace.Annotations[proxyConcurrencyAnnotation]; ok {
+		if n, err := strconv.ParseInt(value, 10, 32); err != nil || n < 0 {
+			h.invalidProxyConfig(invalid, appNamespace, proxyConcurrencyAnnotation, value)
+		} else {
+			concurrency = int(n)
+		}
+	}
+	if concurrency >= 0 {
+		spec.Concurrency = &wrappers.Int32Value{Value: int32(concurrency)}
+	}
+
+	imageType := h.proxyImageType
+	if value, ok := appNamespace.Annotations[proxyImageTypeAnnotation]; ok {
+		if !proxyImageTypes[value] {
+			h.invalidProxyConfig(invalid, appNamespace, proxyImageTypeAnnotation, value)
+		} else {
+			imageType = value
+		}
+	}
+	if imageType != "" {
+		spec.Image = &networkingapiv1beta1.ProxyImage{
+			ImageType: imageType,
+		}
+	}
+
+	invalid.flush()
+
+	if spec.Concurrency == nil && spec.Image == nil {
+		return nil
+	}
+
+	resp.Objects(proxyConfig)
+	return nil
+}
+
+// invalidProxyConfig reports the invalid value of a proxy annotation of the app namespace, once until the value
+// changes
+func (h Handler) invalidProxyConfig(invalid *warnings, appNamespace *corev1.Namespace, annotation, value string) {
+	invalid.add(annotation+"="+value, func() {
+		logrus.Warnf("Ignoring invalid value %q of annotation %s on namespace %s", value, annotation, appNamespace.Name)
+		h.eventf(appNamespace, corev1.EventTypeWarning, "InvalidProxyConfig",
+			"Ignoring invalid value %q of annotation %s", value, annotation)
+	})
+}
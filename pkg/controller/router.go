@@ -1,13 +1,16 @@
 package controller
 
 import (
+	"strings"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/hostname"
 	"github.com/acorn-io/baaah/pkg/router"
+	networkingv1beta1 "istio.io/client-go/pkg/apis/networking/v1beta1"
 	securityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
-	netv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/selection"
-	"k8s.io/client-go/kubernetes"
 )
 
 var (
@@ -25,13 +28,42 @@ var (
 	linkLabel         = "acorn.io/link-name"
 )
 
-func RegisterRoutes(router *router.Router, client kubernetes.Interface, debugImage, allowTrafficFromNamespaces string) error {
-	h := Handler{
-		client:                     client,
-		debugImage:                 debugImage,
-		allowTrafficFromNamespaces: allowTrafficFromNamespaces,
+func newHandler(router *router.Router, opt Options) (Handler, error) {
+	projects, err := newProjectFilter(opt.IncludeProjects, opt.ExcludeProjects)
+	if err != nil {
+		return Handler{}, err
 	}
 
+	return Handler{
+		client:                     opt.K8s,
+		debugImage:                 opt.DebugImage,
+		shutdownCommand:            opt.ShutdownCommand,
+		allowTrafficFromNamespaces: opt.AllowTrafficFromNamespaces,
+		localTrafficSourceCIDRs:    splitList(opt.LocalTrafficSourceCIDRs),
+		recorder:                   newRecorder(opt.K8s),
+		orphanSweepInterval:        opt.OrphanSweepInterval,
+		sidecarShutdownDeadline:    opt.SidecarShutdownDeadline,
+		deleteStuckJobPods:         opt.DeleteStuckJobPods,
+		proxyConcurrency:           opt.ProxyConcurrency,
+		proxyImageType:             opt.ProxyImageType,
+		scopeSidecarEgress:         opt.ScopeSidecarEgress,
+		sidecarEgressNamespaces:    splitList(opt.SidecarEgressNamespaces),
+		externalLinkTLSOrigination: opt.ExternalLinkTLSOrigination,
+		egressLockdown:             opt.EgressLockdown,
+		egressHintInterval:         opt.EgressHintInterval,
+		blockedConnections:         newBlockedConnections(),
+		resolver:                   hostname.NewResolver(opt.ClusterDomain),
+		trigger:                    router.Backend(),
+		driftedObjects:             newDriftedObjects(),
+		pendingChanges:             newPendingChanges(),
+		reportedWarnings:           newReportedWarnings(),
+		linkTargets:                newLinkTargets(),
+		projects:                   projects,
+		appInstances:               appInstancesServed(opt.K8s.Discovery()),
+	}, nil
+}
+
+func RegisterRoutes(router *router.Router, h Handler) error {
 	managedSelector, err := getAcornManagedSelector()
 	if err != nil {
 		return err
@@ -52,17 +84,48 @@ func RegisterRoutes(router *router.Router, client kubernetes.Interface, debugIma
 		return err
 	}
 
-	router.Type(&corev1.Namespace{}).Selector(projectSelector).HandlerFunc(AddLabels)
-	router.Type(&corev1.Namespace{}).Selector(appNamespaceSelector).HandlerFunc(h.PoliciesForApp)
-	router.Type(&netv1.Ingress{}).Selector(managedSelector).HandlerFunc(PoliciesForIngress)
+	router.Type(&corev1.Namespace{}).Selector(projectSelector).HandlerFunc(h.AddLabels)
+	router.Type(&corev1.Namespace{}).HandlerFunc(h.Deenroll)
+	router.Type(&corev1.Namespace{}).Selector(appNamespaceSelector).Middleware(h.EnrolledAppsOnly, TrackOwner, h.RecordEvents).HandlerFunc(h.PoliciesForApp)
+	router.Type(&corev1.Namespace{}).Selector(appNamespaceSelector).Middleware(h.EnrolledAppsOnly, TrackOwner, h.RecordEvents).HandlerFunc(h.PoliciesForWorkloads)
+	router.Type(&corev1.Namespace{}).Selector(appNamespaceSelector).Middleware(h.EnrolledAppsOnly, TrackOwner, h.RecordEvents).HandlerFunc(h.ProxyConfigForApp)
+	router.Type(&corev1.Namespace{}).Selector(appNamespaceSelector).Middleware(h.EnrolledAppsOnly, TrackOwner, h.RecordEvents).HandlerFunc(h.SidecarForApp)
 	router.Type(&securityv1beta1.PeerAuthentication{}).Selector(managedSelector).HandlerFunc(GCOrphans)
 	router.Type(&securityv1beta1.AuthorizationPolicy{}).Selector(managedSelector).HandlerFunc(GCOrphans)
-	router.Type(&corev1.Service{}).Selector(managedSelector).HandlerFunc(PoliciesForService)
-	router.Type(&corev1.Pod{}).Selector(managedSelector).Selector(jobSelector).HandlerFunc(h.KillIstioSidecar)
-	router.Type(&corev1.Service{}).Selector(linkSelector).HandlerFunc(VirtualServiceForLink)
+	router.Type(&corev1.Service{}).Selector(managedSelector).Middleware(TrackOwner, h.RecordEvents).HandlerFunc(h.PoliciesForService)
+	router.Type(&corev1.Pod{}).Selector(managedSelector).Selector(jobSelector).Middleware(h.RecordEvents).HandlerFunc(h.KillIstioSidecar)
+	router.Type(&batchv1.Job{}).Selector(managedSelector).Selector(jobSelector).Middleware(h.RecordEvents).HandlerFunc(h.KillJobSidecars)
+	router.Type(&corev1.Service{}).Selector(linkSelector).Middleware(TrackOwner, h.RecordEvents).HandlerFunc(h.VirtualServiceForLink)
+	router.Type(&corev1.Service{}).IncludeRemoved().HandlerFunc(h.TrackLinkTargets)
+	router.Type(&corev1.Service{}).IncludeRemoved().HandlerFunc(h.ForgetWarnings)
+	router.Type(&corev1.Namespace{}).IncludeRemoved().HandlerFunc(h.ForgetWarnings)
+
+	// Delete managed objects whose owner is gone, even if it lived in a different namespace
+	router.Type(&securityv1beta1.PeerAuthentication{}).Selector(managedSelector).HandlerFunc(h.SweepOrphans)
+	router.Type(&securityv1beta1.AuthorizationPolicy{}).Selector(managedSelector).HandlerFunc(h.SweepOrphans)
+	router.Type(&networkingv1beta1.VirtualService{}).Selector(managedSelector).HandlerFunc(h.SweepOrphans)
+	router.Type(&networkingv1beta1.ProxyConfig{}).Selector(managedSelector).HandlerFunc(h.SweepOrphans)
+	router.Type(&networkingv1beta1.Sidecar{}).Selector(managedSelector).HandlerFunc(h.SweepOrphans)
+	router.Type(&networkingv1beta1.ServiceEntry{}).Selector(managedSelector).HandlerFunc(h.SweepOrphans)
+	router.Type(&networkingv1beta1.DestinationRule{}).Selector(managedSelector).HandlerFunc(h.SweepOrphans)
 
-	// Delete existing AuthorizationPolicies
-	router.Type(&securityv1beta1.AuthorizationPolicy{}).HandlerFunc(DoNothing)
+	// Report and revert changes made to managed objects outside of the plugin
+	router.Type(&securityv1beta1.PeerAuthentication{}).Selector(managedSelector).IncludeRemoved().HandlerFunc(h.DetectDrift)
+	router.Type(&securityv1beta1.AuthorizationPolicy{}).Selector(managedSelector).IncludeRemoved().HandlerFunc(h.DetectDrift)
+	router.Type(&networkingv1beta1.VirtualService{}).Selector(managedSelector).IncludeRemoved().HandlerFunc(h.DetectDrift)
+	router.Type(&networkingv1beta1.ProxyConfig{}).Selector(managedSelector).IncludeRemoved().HandlerFunc(h.DetectDrift)
+	router.Type(&networkingv1beta1.Sidecar{}).Selector(managedSelector).IncludeRemoved().HandlerFunc(h.DetectDrift)
+	router.Type(&networkingv1beta1.ServiceEntry{}).Selector(managedSelector).IncludeRemoved().HandlerFunc(h.DetectDrift)
+	router.Type(&networkingv1beta1.DestinationRule{}).Selector(managedSelector).IncludeRemoved().HandlerFunc(h.DetectDrift)
+
+	// Report the objects created or updated by the handlers once they are applied
+	router.Type(&securityv1beta1.PeerAuthentication{}).Selector(managedSelector).IncludeRemoved().HandlerFunc(h.ConfirmChanges)
+	router.Type(&securityv1beta1.AuthorizationPolicy{}).Selector(managedSelector).IncludeRemoved().HandlerFunc(h.ConfirmChanges)
+	router.Type(&networkingv1beta1.VirtualService{}).Selector(managedSelector).IncludeRemoved().HandlerFunc(h.ConfirmChanges)
+	router.Type(&networkingv1beta1.ProxyConfig{}).Selector(managedSelector).IncludeRemoved().HandlerFunc(h.ConfirmChanges)
+	router.Type(&networkingv1beta1.Sidecar{}).Selector(managedSelector).IncludeRemoved().HandlerFunc(h.ConfirmChanges)
+	router.Type(&networkingv1beta1.ServiceEntry{}).Selector(managedSelector).IncludeRemoved().HandlerFunc(h.ConfirmChanges)
+	router.Type(&networkingv1beta1.DestinationRule{}).Selector(managedSelector).IncludeRemoved().HandlerFunc(h.ConfirmChanges)
 	return nil
 }
 
@@ -102,3 +165,14 @@ func getLinkSelector() (labels.Selector, error) {
 	}
 	return labels.NewSelector().Add(*req), nil
 }
+
+// splitList splits a comma-separated flag value, dropping empty entries and surrounding whitespace
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/self"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// curlShutdownCommand is used with a custom debug image, which needs to have curl installed
+var curlShutdownCommand = []string{"curl", "-X", "POST", "http://localhost:15000/quitquitquit"}
+
+// selfShutdownCommand returns the command that runs the quit-sidecar subcommand of this binary, for shutdown
+// containers that use the plugin's own image
+func selfShutdownCommand() ([]string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return []string{executable, "quit-sidecar"}, nil
+}
+
+// selfImage returns the image of the plugin's pod, by digest when the container runtime reports it, so that
+// shutdown containers run exactly the same binary as the controller.
+// The pod is found from its hostname (or the POD_NAME and POD_NAMESPACE environment variables, if set).
+func selfImage(ctx context.Context, k8s kubernetes.Interface) (string, error) {
+	podName, err := self.PodName()
+	if err != nil {
+		return "", err
+	}
+	podNamespace, err := self.Namespace()
+	if err != nil {
+		return "", err
+	}
+
+	pod, err := k8s.CoreV1().Pods(podNamespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get the plugin's pod to find its image: %w", err)
+	}
+
+	image := podImage(pod)
+	if image == "" {
+		return "", fmt.Errorf("failed to find the image of pod %s/%s", podNamespace, podName)
+	}
+	return image, nil
+}
+
+// podImage returns the image of the first container that isn't the Istio sidecar, preferring the image digest
+// reported in the container status over the image reference from the pod spec
+func podImage(pod *corev1.Pod) string {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == proxySidecarContainerName {
+			continue
+		}
+		imageID := strings.TrimPrefix(status.ImageID, "docker-pullable://")
+		if strings.Contains(imageID, "@sha256:") {
+			return imageID
+		}
+		return status.Image
+	}
+
+	for _, container := range pod.Spec.Containers {
+		if container.Name != proxySidecarContainerName {
+			return container.Image
+		}
+	}
+	return ""
+}
@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestPodImage(t *testing.T) {
+	spec := corev1.PodSpec{
+		Containers: []corev1.Container{
+			{Name: proxySidecarContainerName, Image: "docker.io/istio/proxyv2:1.17.1"},
+			{Name: "istio-plugin-controller", Image: "ghcr.io/acorn-io/acorn-istio-plugin:main"},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		statuses []corev1.ContainerStatus
+		expected string
+	}{
+		{
+			name:     "no status",
+			expected: "ghcr.io/acorn-io/acorn-istio-plugin:main",
+		},
+		{
+			name: "containerd digest",
+			statuses: []corev1.ContainerStatus{
+				{Name: proxySidecarContainerName, ImageID: "docker.io/istio/proxyv2@sha256:1111"},
+				{Name: "istio-plugin-controller", Image: "ghcr.io/acorn-io/acorn-istio-plugin:main", ImageID: "ghcr.io/acorn-io/acorn-istio-plugin@sha256:2222"},
+			},
+			expected: "ghcr.io/acorn-io/acorn-istio-plugin@sha256:2222",
+		},
+		{
+			name: "docker digest",
+			statuses: []corev1.ContainerStatus{
+				{Name: "istio-plugin-controller", Image: "ghcr.io/acorn-io/acorn-istio-plugin:main", ImageID: "docker-pullable://ghcr.io/acorn-io/acorn-istio-plugin@sha256:2222"},
+			},
+			expected: "ghcr.io/acorn-io/acorn-istio-plugin@sha256:2222",
+		},
+		{
+			name: "locally built image",
+			statuses: []corev1.ContainerStatus{
+				{Name: "istio-plugin-controller", Image: "istio-plugin:dev", ImageID: "sha256:3333"},
+			},
+			expected: "istio-plugin:dev",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				Spec: spec,
+				Status: corev1.PodStatus{
+					ContainerStatuses: tt.statuses,
+				},
+			}
+			assert.Equal(t, tt.expected, podImage(pod))
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/sirupsen/logrus"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	shutdownContainerName = "shutdown-sidecar"
+	// shutdownEscalatedAnnotation is set on a job pod once the failure to shut down its sidecar was reported
+	shutdownEscalatedAnnotation = "acorn.io/istio-plugin-sidecar-shutdown-escalated"
+
+	// shutdownInitialBackoff is how long to wait before checking on the first shutdown attempt. The delay
+	// doubles with every attempt, up to shutdownMaxBackoff.
+	shutdownInitialBackoff = 5 * time.Second
+	shutdownMaxBackoff     = 2 * time.Minute
+
+	// shutdownGracePeriod is how long the proxy has to exit after a shutdown attempt completed successfully,
+	// before the attempt is considered to have failed
+	shutdownGracePeriod = 30 * time.Second
+)
+
+// now is replaced in tests
+var now = time.Now
+
+// KillIstioSidecar kills the Istio sidecar on every pod that corresponds to an Acorn job, once the job is complete.
+// With the OnFailure restart policy, a container that failed is about to be restarted, so the sidecar is only killed
+// once every container succeeded, or once the owning Job failed.
+// The sidecar is shut down by an ephemeral container. If that container fails, or the proxy is still running after it
+// completed, another one is launched with an increasing backoff. If the proxy is still running once the shutdown
+// deadline has passed, a Warning Event is emitted on the pod, and the pod is deleted if configured to do so and the
+// Job that owns it is complete.
+func (h Handler) KillIstioSidecar(req router.Request, resp router.Response) error {
+	pod := req.Object.(*corev1.Pod)
+
+	if _, ok := pod.Labels["acorn.io/job-name"]; !ok {
+		return nil // pod doesn't belong to the job, so skip it
+	}
+
+	if pod.Spec.RestartPolicy == corev1.RestartPolicyAlways {
+		return nil // containers are restarted even when they succeed, so the pod never finishes
+	}
+
+	foundSidecar := false
+	var finishedAt time.Time
+	succeeded := true
+	for _, containerStatus := range pod.Status.ContainerStatuses {
+		if containerStatus.Name == proxySidecarContainerName {
+			if containerStatus.State.Terminated != nil {
+				return nil // the sidecar is already gone
+			}
+			foundSidecar = true
+			continue
+		}
+
+		terminated := containerStatus.State.Terminated
+		if terminated == nil {
+			return nil
+		}
+		if terminated.FinishedAt.Time.After(finishedAt) {
+			finishedAt = terminated.FinishedAt.Time
+		}
+		if terminated.ExitCode != 0 {
+			succeeded = false
+		}
+	}
+
+	if !foundSidecar {
+		return nil
+	}
+
+	if !succeeded {
+		// The kubelet restarts failed containers unless the restart policy is Never, so the workload is only
+		// finished once the Job gave up on it
+		finished, err := h.jobGaveUp(req, pod)
+		if err != nil || !finished {
+			return err
+		}
+	}
+
+	return h.shutdownSidecar(req, resp, pod, finishedAt)
+}
+
+// KillJobSidecars shuts down the Istio sidecar of every remaining pod of an Acorn Job, once the Job is complete or has
+// failed. This catches the pods that KillIstioSidecar missed, such as the ones that finished while the controller was
+// down, or the extra pods of Jobs using parallelism and completions.
+func (h Handler) KillJobSidecars(req router.Request, resp router.Response) error {
+	job := req.Object.(*batchv1.Job)
+
+	finishedAt, _, finished := jobFinished(job)
+	if !finished || job.Spec.Selector == nil {
+		return nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(job.Spec.Selector)
+	if err != nil {
+		return err
+	}
+
+	pods := corev1.PodList{}
+	if err := req.List(&pods, &kclient.ListOptions{
+		Namespace:     job.Namespace,
+		LabelSelector: selector,
+	}); err != nil {
+		return err
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil || !sidecarRunning(pod) {
+			continue
+		}
+		if err := h.shutdownSidecar(req, resp, pod.DeepCopy(), finishedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shutdownSidecar launches a shutdown container in the pod, or checks on the previous ones and tries again or escalates
+func (h Handler) shutdownSidecar(req router.Request, resp router.Response, pod *corev1.Pod, finishedAt time.Time) error {
+	attempts := shutdownAttempts(pod)
+	if len(attempts) == 0 {
+		resp.RetryAfter(shutdownBackoff(0))
+		return h.launchShutdownContainer(req, pod, 0)
+	}
+
+	if h.sidecarShutdownDeadline > 0 && !finishedAt.IsZero() && now().Sub(finishedAt) > h.sidecarShutdownDeadline {
+		return h.escalateSidecarShutdown(req, pod, len(attempts))
+	}
+
+	last := len(attempts) - 1
+	failedAt, failed := shutdownAttemptFailed(pod, attempts[last])
+	if !failed {
+		resp.RetryAfter(shutdownBackoff(last))
+		return nil
+	}
+
+	if wait := shutdownBackoff(last) - now().Sub(failedAt); wait > 0 {
+		resp.RetryAfter(wait)
+		return nil
+	}
+
+	resp.RetryAfter(shutdownBackoff(len(attempts)))
+	return h.launchShutdownContainer(req, pod, len(attempts))
+}
+
+func (h Handler) launchShutdownContainer(req router.Request, pod *corev1.Pod, attempt int) error {
+	containerName := shutdownContainerName
+	if attempt > 0 {
+		containerName = fmt.Sprintf("%s-%d", shutdownContainerName, attempt)
+	}
+
+	command := h.shutdownCommand
+	if len(command) == 0 {
+		command = curlShutdownCommand
+	}
+
+	logrus.Infof("Launching ephemeral container %v to kill pod %v/%v sidecar", containerName, pod.Namespace, pod.Name)
+	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, corev1.EphemeralContainer{
+		TargetContainerName: proxySidecarContainerName,
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+			Name:            containerName,
+			Image:           h.debugImage,
+			ImagePullPolicy: corev1.PullAlways,
+			Command:         command,
+		},
+	})
+	if _, err := h.client.CoreV1().Pods(pod.Namespace).UpdateEphemeralContainers(req.Ctx, pod.Name, pod, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	h.eventf(pod, corev1.EventTypeNormal, "ShuttingDownSidecar", "Launched ephemeral container %s to shut down the Istio sidecar", containerName)
+
+	return nil
+}
+
+// escalateSidecarShutdown emits a Warning Event on the pod the first time that its sidecar is still running after the
+// deadline, recording it in an annotation so that it isn't repeated, and deletes the pod if configured to do so once
+// the Job that owns it is complete. Deleting a pod of a Job that isn't complete would make the Job controller count it
+// as failed and start a replacement.
+func (h Handler) escalateSidecarShutdown(req router.Request, pod *corev1.Pod, attempts int) error {
+	if pod.Annotations[shutdownEscalatedAnnotation] != "true" {
+		logrus.Warnf("Istio sidecar of pod %v/%v is still running after %d shutdown attempts", pod.Namespace, pod.Name, attempts)
+		h.eventf(pod, corev1.EventTypeWarning, "SidecarShutdownFailed",
+			"Istio sidecar is still running %v after the job finished, after %d shutdown attempts", h.sidecarShutdownDeadline, attempts)
+
+		patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:"true"}}}`, shutdownEscalatedAnnotation)
+		if _, err := h.client.CoreV1().Pods(pod.Namespace).Patch(req.Ctx, pod.Name, types.MergePatchType, []byte(patch), metav1.PatchOptions{}); err != nil {
+			return err
+		}
+	}
+
+	if !h.deleteStuckJobPods {
+		return nil
+	}
+	job, err := owningJob(req, pod)
+	if err != nil || job == nil {
+		return err
+	}
+	if _, succeeded, finished := jobFinished(job); !finished || !succeeded {
+		return nil
+	}
+
+	logrus.Infof("Deleting pod %v/%v because its job succeeded but its Istio sidecar could not be shut down", pod.Namespace, pod.Name)
+	if err := h.client.CoreV1().Pods(pod.Namespace).Delete(req.Ctx, pod.Name, metav1.DeleteOptions{}); err != nil && !apierror.IsNotFound(err) {
+		return err
+	}
+	h.eventf(pod, corev1.EventTypeNormal, "DeletedStuckPod", "Deleted pod because its job succeeded but its Istio sidecar could not be shut down")
+	return nil
+}
+
+// jobGaveUp returns true if the pod's containers won't be restarted anymore, either because of the pod's restart
+// policy or because the Job that owns the pod has failed.
+func (h Handler) jobGaveUp(req router.Request, pod *corev1.Pod) (bool, error) {
+	if pod.Spec.RestartPolicy == corev1.RestartPolicyNever {
+		return true, nil
+	}
+
+	job, err := owningJob(req, pod)
+	if err != nil || job == nil {
+		return false, err
+	}
+	_, succeeded, finished := jobFinished(job)
+	return finished && !succeeded, nil
+}
+
+// owningJob returns the Job that owns the pod, or nil if there is none
+func owningJob(req router.Request, pod *corev1.Pod) (*batchv1.Job, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.Kind != "Job" || owner.APIVersion != batchv1.SchemeGroupVersion.String() {
+		return nil, nil
+	}
+
+	job := &batchv1.Job{}
+	if err := req.Get(job, pod.Namespace, owner.Name); apierror.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// jobFinished returns the time at which the Job completed or failed, and whether it succeeded
+func jobFinished(job *batchv1.Job) (time.Time, bool, bool) {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			return condition.LastTransitionTime.Time, true, true
+		case batchv1.JobFailed:
+			return condition.LastTransitionTime.Time, false, true
+		}
+	}
+	return time.Time{}, false, false
+}
+
+// sidecarRunning returns true if the pod has an Istio sidecar that hasn't terminated yet
+func sidecarRunning(pod *corev1.Pod) bool {
+	for _, containerStatus := range pod.Status.ContainerStatuses {
+		if containerStatus.Name == proxySidecarContainerName {
+			return containerStatus.State.Terminated == nil
+		}
+	}
+	return false
+}
+
+// shutdownAttempts returns the names of the ephemeral containers launched by KillIstioSidecar, oldest first.
+// Other ephemeral containers, such as ones created by kubectl debug, are ignored.
+func shutdownAttempts(pod *corev1.Pod) []string {
+	var result []string
+	for _, container := range pod.Spec.EphemeralContainers {
+		if container.Name == shutdownContainerName || strings.HasPrefix(container.Name, shutdownContainerName+"-") {
+			result = append(result, container.Name)
+		}
+	}
+	return result
+}
+
+// shutdownAttemptFailed returns true, along with the time at which it failed, if the shutdown container exited
+// with an error, or if it succeeded but the proxy was still running after a grace period.
+// Containers that can't be pulled are not considered as failed, since the kubelet keeps retrying on its own.
+func shutdownAttemptFailed(pod *corev1.Pod, containerName string) (time.Time, bool) {
+	for _, status := range pod.Status.EphemeralContainerStatuses {
+		if status.Name != containerName || status.State.Terminated == nil {
+			continue
+		}
+
+		terminated := status.State.Terminated
+		if terminated.ExitCode != 0 {
+			return terminated.FinishedAt.Time, true
+		}
+		if now().Sub(terminated.FinishedAt.Time) > shutdownGracePeriod {
+			return terminated.FinishedAt.Add(shutdownGracePeriod), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// shutdownBackoff returns how long to wait after the given shutdown attempt before trying again
+func shutdownBackoff(attempt int) time.Duration {
+	backoff := shutdownInitialBackoff
+	for i := 0; i < attempt && backoff < shutdownMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > shutdownMaxBackoff {
+		return shutdownMaxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/acorn-io/baaah/pkg/apply"
+	networkingv1beta1 "istio.io/client-go/pkg/apis/networking/v1beta1"
+	securityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// managedObjectLists returns an empty list of every kind of Istio object that the plugin generates
+func managedObjectLists() []kclient.ObjectList {
+	return []kclient.ObjectList{
+		&securityv1beta1.PeerAuthenticationList{},
+		&securityv1beta1.AuthorizationPolicyList{},
+		&networkingv1beta1.VirtualServiceList{},
+		&networkingv1beta1.ProxyConfigList{},
+		&networkingv1beta1.SidecarList{},
+		&networkingv1beta1.ServiceEntryList{},
+		&networkingv1beta1.DestinationRuleList{},
+	}
+}
+
+// Uninstall deletes the Istio objects generated by the plugin, and removes the injection labels that AddLabels added
+// to the project namespaces. It returns a description of each change, which are only described, as what would be
+// done, with dryRun. The plugin must be stopped first, or it generates everything again.
+func Uninstall(ctx context.Context, c kclient.Client, dryRun bool) ([]string, error) {
+	var changes []string
+	deleted, removed := "deleted", "removed"
+	if dryRun {
+		deleted, removed = "would delete", "would remove"
+	}
+
+	for _, list := range managedObjectLists() {
+		if err := c.List(ctx, list, kclient.MatchingLabels{acornManagedLabel: "true"}); err != nil {
+			return changes, err
+		}
+		err := meta.EachListItem(list, func(o runtime.Object) error {
+			obj := o.(kclient.Object)
+			if obj.GetAnnotations()[apply.LabelSubContext] != routerName {
+				return nil
+			}
+
+			gvk, err := apiutil.GVKForObject(obj, c.Scheme())
+			if err != nil {
+				return err
+			}
+			if !dryRun {
+				if err := c.Delete(ctx, obj); err != nil && !apierror.IsNotFound(err) {
+					return err
+				}
+			}
+			changes = append(changes, fmt.Sprintf("%s %s %s/%s", deleted, gvk.Kind, obj.GetNamespace(), obj.GetName()))
+			return nil
+		})
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	namespaces := &corev1.NamespaceList{}
+	if err := c.List(ctx, namespaces); err != nil {
+		return changes, err
+	}
+	for i := range namespaces.Items {
+		ns := &namespaces.Items[i]
+		if ns.Annotations[injectionAddedAnnotation] != "true" {
+			continue
+		}
+
+		labelRemoved := removeInjectionLabel(ns)
+		if !dryRun {
+			if err := c.Update(ctx, ns); err != nil {
+				return changes, err
+			}
+		}
+		if labelRemoved {
+			changes = append(changes, fmt.Sprintf("%s the %s label from namespace %s", removed, injectionLabel, ns.Name))
+		}
+	}
+	return changes, nil
+}
+
+// removeInjectionLabel removes the injection label added by AddLabels along with the annotation tracking it, and
+// returns true if the label was removed. A label that was changed since then is kept.
+func removeInjectionLabel(ns *corev1.Namespace) bool {
+	delete(ns.Annotations, injectionAddedAnnotation)
+	if ns.Labels[injectionLabel] != "enabled" {
+		return false
+	}
+	delete(ns.Labels, injectionLabel)
+	return true
+}
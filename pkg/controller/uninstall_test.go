@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/scheme"
+	"github.com/acorn-io/baaah/pkg/apply"
+	"github.com/stretchr/testify/assert"
+	networkingv1beta1 "istio.io/client-go/pkg/apis/networking/v1beta1"
+	securityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestUninstall(t *testing.T) {
+	generated := metav1.ObjectMeta{
+		Namespace:   "my-app-namespace",
+		Labels:      map[string]string{acornManagedLabel: "true"},
+		Annotations: map[string]string{apply.LabelSubContext: routerName},
+	}
+	strict := &securityv1beta1.PeerAuthentication{ObjectMeta: *generated.DeepCopy()}
+	strict.Name = "my-app-namespace-strict"
+	link := &networkingv1beta1.VirtualService{ObjectMeta: *generated.DeepCopy()}
+	link.Name = "my-link"
+	// Labeled by Acorn, but not generated by the plugin
+	other := &securityv1beta1.PeerAuthentication{ObjectMeta: metav1.ObjectMeta{
+		Name:      "other",
+		Namespace: "my-app-namespace",
+		Labels:    map[string]string{acornManagedLabel: "true"},
+	}}
+
+	project := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "acorn",
+		Labels:      map[string]string{injectionLabel: "enabled", "acorn.io/project": "true"},
+		Annotations: map[string]string{injectionAddedAnnotation: "true"},
+	}}
+	manual := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   "manual",
+		Labels: map[string]string{injectionLabel: "enabled", "acorn.io/project": "true"},
+	}}
+
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(strict, link, other, project, manual).Build()
+
+	// A dry run only says what would change
+	dryRunChanges, err := Uninstall(context.Background(), c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{
+		"would delete PeerAuthentication my-app-namespace/my-app-namespace-strict",
+		"would delete VirtualService my-app-namespace/my-link",
+		"would remove the istio-injection label from namespace acorn",
+	}, dryRunChanges)
+	assert.NoError(t, c.Get(context.Background(), kclient.ObjectKeyFromObject(strict), &securityv1beta1.PeerAuthentication{}))
+	assert.NoError(t, c.Get(context.Background(), kclient.ObjectKeyFromObject(link), &networkingv1beta1.VirtualService{}))
+	unchanged := &corev1.Namespace{}
+	if err := c.Get(context.Background(), kclient.ObjectKeyFromObject(project), unchanged); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "enabled", unchanged.Labels[injectionLabel])
+	assert.Equal(t, "true", unchanged.Annotations[injectionAddedAnnotation])
+
+	changes, err := Uninstall(context.Background(), c, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{
+		"deleted PeerAuthentication my-app-namespace/my-app-namespace-strict",
+		"deleted VirtualService my-app-namespace/my-link",
+		"removed the istio-injection label from namespace acorn",
+	}, changes)
+
+	assert.True(t, apierror.IsNotFound(c.Get(context.Background(), kclient.ObjectKeyFromObject(strict), &securityv1beta1.PeerAuthentication{})))
+	assert.True(t, apierror.IsNotFound(c.Get(context.Background(), kclient.ObjectKeyFromObject(link), &networkingv1beta1.VirtualService{})))
+	assert.NoError(t, c.Get(context.Background(), kclient.ObjectKeyFromObject(other), &securityv1beta1.PeerAuthentication{}))
+
+	for _, ns := range []*corev1.Namespace{project, manual} {
+		if err := c.Get(context.Background(), kclient.ObjectKeyFromObject(ns), ns); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.NotContains(t, project.Labels, injectionLabel)
+	assert.NotContains(t, project.Annotations, injectionAddedAnnotation)
+	assert.Equal(t, "enabled", manual.Labels[injectionLabel])
+}
@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"sync"
+
+	"github.com/acorn-io/baaah/pkg/router"
+)
+
+// reportedWarnings remembers the warnings of each reason found by the last reconcile of each object, so that a warning
+// is reported when it appears instead of on every reconcile. A nil *reportedWarnings is valid and reports every
+// warning.
+type reportedWarnings struct {
+	lock    sync.Mutex
+	objects map[string]map[string]map[string]bool
+}
+
+func newReportedWarnings() *reportedWarnings {
+	return &reportedWarnings{
+		objects: map[string]map[string]map[string]bool{},
+	}
+}
+
+// update records the warnings of the reason found by a reconcile of the object, forgetting the ones that are gone,
+// and returns the ones that the previous reconcile didn't find
+func (r *reportedWarnings) update(object, reason string, found []string) map[string]bool {
+	result := map[string]bool{}
+	if r == nil {
+		for _, key := range found {
+			result[key] = true
+		}
+		return result
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	current := map[string]bool{}
+	for _, key := range found {
+		if !r.objects[object][reason][key] {
+			result[key] = true
+		}
+		current[key] = true
+	}
+	if len(current) > 0 {
+		if r.objects[object] == nil {
+			r.objects[object] = map[string]map[string]bool{}
+		}
+		r.objects[object][reason] = current
+	} else if r.objects[object] != nil {
+		delete(r.objects[object], reason)
+		if len(r.objects[object]) == 0 {
+			delete(r.objects, object)
+		}
+	}
+	return result
+}
+
+// forget drops the warnings of an object that was deleted, so that they are reported again if it is created again
+func (r *reportedWarnings) forget(object string) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.objects, object)
+}
+
+// warnings collects the warnings of one reason found while handling an object
+type warnings struct {
+	reported *reportedWarnings
+	object   string
+	reason   string
+	keys     []string
+	reports  map[string]func()
+}
+
+// warnings returns a collector for the warnings of the reason found while handling the request
+func (h Handler) warnings(req router.Request, reason string) *warnings {
+	return &warnings{
+		reported: h.reportedWarnings,
+		object:   warningsObject(req),
+		reason:   reason,
+		reports:  map[string]func(){},
+	}
+}
+
+func warningsObject(req router.Request) string {
+	return req.GVK.Kind + " " + req.Key
+}
+
+// add records the warning identified by key, which calls report when it is flushed if the previous reconcile didn't
+// find it
+func (w *warnings) add(key string, report func()) {
+	if _, ok := w.reports[key]; ok {
+		return
+	}
+	w.keys = append(w.keys, key)
+	w.reports[key] = report
+}
+
+// flush reports the new warnings. It is only called once the handler succeeded, since a failed reconcile may have
+// stopped before finding every warning.
+func (w *warnings) flush() {
+	isNew := w.reported.update(w.object, w.reason, w.keys)
+	for _, key := range w.keys {
+		if isNew[key] {
+			w.reports[key]()
+		}
+	}
+}
+
+// ForgetWarnings forgets the warnings reported for objects that were deleted
+func (h Handler) ForgetWarnings(req router.Request, resp router.Response) error {
+	if req.Object == nil {
+		h.reportedWarnings.forget(warningsObject(req))
+	}
+	return nil
+}
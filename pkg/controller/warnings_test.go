@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/acorn-io/baaah/pkg/router/tester"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestReportedWarnings(t *testing.T) {
+	r := newReportedWarnings()
+
+	assert.Equal(t, map[string]bool{"a": true, "b": true}, r.update("object", "reason", []string{"a", "b"}))
+	// Warnings that are still found aren't reported again
+	assert.Equal(t, map[string]bool{"c": true}, r.update("object", "reason", []string{"a", "b", "c"}))
+	assert.Equal(t, map[string]bool{"a": true}, r.update("object", "other", []string{"a"}))
+	assert.Equal(t, map[string]bool{"a": true}, r.update("other", "reason", []string{"a"}))
+	// Warnings that are gone are reported again when they come back
+	assert.Empty(t, r.update("object", "reason", []string{"b"}))
+	assert.Equal(t, map[string]bool{"a": true}, r.update("object", "reason", []string{"a", "b"}))
+
+	assert.Empty(t, r.update("object", "reason", nil))
+	assert.Empty(t, r.update("object", "other", nil))
+	assert.NotContains(t, r.objects, "object")
+}
+
+func TestHandler_ForgetWarnings(t *testing.T) {
+	h := Handler{reportedWarnings: newReportedWarnings()}
+	req := router.Request{
+		GVK: corev1.SchemeGroupVersion.WithKind("Service"),
+		Key: "my-app-namespace/my-service",
+	}
+	h.reportedWarnings.update(warningsObject(req), "EmptySelector", []string{"a"})
+
+	// The warnings of a deleted object are forgotten
+	if err := h.ForgetWarnings(req, &tester.Response{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, h.reportedWarnings.objects)
+}
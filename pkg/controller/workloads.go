@@ -0,0 +1,322 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/hostname"
+	"github.com/acorn-io/baaah/pkg/name"
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/sirupsen/logrus"
+	"istio.io/api/security/v1beta1"
+	typev1beta1 "istio.io/api/type/v1beta1"
+	securityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// PoliciesForWorkloads creates an Istio PeerAuthentication for each workload in an app's namespace that has ports
+// published by an Ingress or by a LoadBalancer or NodePort Service created by Acorn. The PeerAuthentication sets mTLS
+// to PERMISSIVE mode on those ports so that the containers will accept traffic coming from outside the Istio mesh.
+// Istio only applies the oldest PeerAuthentication when several of them select the same pods, so the ports from every
+// Ingress and Service are merged into a single PeerAuthentication per workload selector.
+// When the cluster serves Acorn's AppInstances, the ports published by the app are read from its AppInstance instead
+// of its Services and Ingresses, and only the Ingresses of other apps linking to it are looked at.
+func (h Handler) PoliciesForWorkloads(req router.Request, resp router.Response) error {
+	appNamespace := req.Object.(*corev1.Namespace)
+	workloads := workloadPorts{}
+
+	app, err := h.appInstance(req, appNamespace)
+	if err != nil {
+		return err
+	}
+	if app != nil {
+		addAppInstancePorts(workloads, app)
+	} else if err := addServicePorts(req, workloads, appNamespace.Name); err != nil {
+		return err
+	}
+
+	// Ingresses can live in a different namespace than the app they publish when Acorn links are involved, so look
+	// at the Ingresses of the namespaces linking to this one too, as recorded by TrackLinkTargets, and only keep the
+	// ports that belong to this namespace. Listing them by namespace keeps the other Ingresses from triggering this
+	// namespace.
+	ingressNamespaces := h.linkTargets.linking(appNamespace.Name)
+	if app == nil {
+		// Otherwise already covered by the ports of the AppInstance
+		ingressNamespaces = append([]string{appNamespace.Name}, ingressNamespaces...)
+	}
+	ingressWarnings := ingressWarnings{
+		emptySelector:  h.warnings(req, "EmptySelector"),
+		targetNotFound: h.warnings(req, "LinkTargetNotFound"),
+	}
+	for _, namespace := range ingressNamespaces {
+		ingresses := netv1.IngressList{}
+		if err := req.List(&ingresses, &kclient.ListOptions{
+			Namespace:     namespace,
+			LabelSelector: acornManagedSelector,
+		}); err != nil {
+			return err
+		}
+		for i := range ingresses.Items {
+			if err := h.addIngressPorts(req, workloads, ingressWarnings, appNamespace.Name, &ingresses.Items[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	// One PeerAuthentication per workload, sorted by selector
+	for _, w := range workloads.sorted() {
+		peerAuth := w.peerAuthentication(appNamespace.Name)
+		if err := h.recordOpenedPorts(req, peerAuth, w); err != nil {
+			return err
+		}
+		resp.Objects(peerAuth)
+	}
+	ingressWarnings.emptySelector.flush()
+	ingressWarnings.targetNotFound.flush()
+	return nil
+}
+
+// addServicePorts adds the ports published by the LoadBalancer and NodePort Services of the namespace to the workloads
+// that they target
+func addServicePorts(req router.Request, workloads workloadPorts, namespace string) error {
+	services := corev1.ServiceList{}
+	if err := req.List(&services, &kclient.ListOptions{
+		Namespace:     namespace,
+		LabelSelector: acornManagedSelector,
+	}); err != nil {
+		return err
+	}
+	for i := range services.Items {
+		service := &services.Items[i]
+		if !isPublishedService(service) || len(service.Spec.Selector) == 0 {
+			continue
+		}
+		for _, port := range service.Spec.Ports {
+			workloads.add(service.Spec.Selector, uint32(port.TargetPort.IntVal), "Service", service)
+		}
+	}
+	return nil
+}
+
+// recordOpenedPorts records an Event on each Ingress, Service, or AppInstance that caused ports of the workload to become
+// PERMISSIVE, when these ports weren't already PERMISSIVE. The Events are emitted by ConfirmChanges once the
+// PeerAuthentication is applied.
+func (h Handler) recordOpenedPorts(req router.Request, peerAuth *securityv1beta1.PeerAuthentication, w *workload) error {
+	existing := securityv1beta1.PeerAuthentication{}
+	if err := req.Client.Get(req.Ctx, kclient.ObjectKeyFromObject(peerAuth), &existing); err != nil && !apierror.IsNotFound(err) {
+		return err
+	}
+
+	for _, source := range w.sources {
+		var opened []string
+		for _, port := range source.sortedPorts() {
+			if existing.Spec.PortLevelMtls[port] == nil {
+				opened = append(opened, strconv.Itoa(int(port)))
+			}
+		}
+		if len(opened) == 0 {
+			continue
+		}
+		h.eventfOnApply(peerAuth, source.obj, corev1.EventTypeNormal, "PortsOpened",
+			"Set mTLS to PERMISSIVE on port(s) %s of the pods matching %s in namespace %s, to accept traffic from outside the mesh",
+			strings.Join(opened, ", "), labels.Set(w.selector).String(), peerAuth.Namespace)
+	}
+	return nil
+}
+
+// ingressWarnings collects the warnings found while adding the ports of the Ingresses
+type ingressWarnings struct {
+	// emptySelector are the Services without a selector
+	emptySelector *warnings
+	// targetNotFound are the links whose target Service doesn't exist
+	targetNotFound *warnings
+}
+
+// ingressPort is a port published by an Ingress on the pods matching the selector
+type ingressPort struct {
+	selector map[string]string
+	port     uint32
+}
+
+// addIngressPorts adds the ports published by the Ingress to the workloads in the given namespace that they target.
+// An Ingress going through a link whose target Service doesn't exist is skipped until the Service is created, which
+// triggers the namespace again, so that the other Ingresses still get their ports.
+func (h Handler) addIngressPorts(req router.Request, workloads workloadPorts, warnings ingressWarnings, namespace string, ingress *netv1.Ingress) error {
+	// Don't process the Ingress resource created for Acorn DNS, since it doesn't refer to any pods
+	if ingress.Name == systemIngress && ingress.Namespace == systemNamespace {
+		return nil
+	}
+
+	// Create a mapping of k8s Service names to published port names/numbers
+	svcNameToPorts := make(map[string][]netv1.ServiceBackendPort)
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			if path.Backend.Service == nil {
+				continue
+			}
+			svcName := path.Backend.Service.Name
+			port := path.Backend.Service.Port
+			svcNameToPorts[svcName] = append(svcNameToPorts[svcName], port)
+		}
+	}
+
+	var published []ingressPort
+	for svcName, ports := range svcNameToPorts {
+		// Get the Service from k8s. Reading it through the request triggers this namespace again when it changes.
+		svc := corev1.Service{}
+		if err := req.Get(&svc, ingress.Namespace, svcName); apierror.IsNotFound(err) {
+			// The service doesn't exist yet, its creation will trigger this namespace again
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// This service is either a normal ClusterIP service or an ExternalName service which
+		// points to a service in a different namespace (if there are Acorn links involved).
+		// If it's an ExternalName, we need to get the service to which it points.
+		if svc.Spec.Type == corev1.ServiceTypeExternalName {
+			externalName := svc.Spec.ExternalName
+
+			target := h.resolver.Resolve(externalName)
+			if target.Kind != hostname.ClusterService || target.Namespace != namespace {
+				// Hosts outside the cluster and Services in other namespaces don't belong to any workload of this namespace
+				continue
+			}
+
+			svc = corev1.Service{}
+			if err := req.Get(&svc, target.Namespace, target.Service); apierror.IsNotFound(err) {
+				warnings.targetNotFound.add(toKey(ingress.Namespace, ingress.Name)+" "+externalName, func() {
+					logrus.Warnf("Skipping Ingress %s/%s, service %s/%s, targeted by ExternalName %s, doesn't exist",
+						ingress.Namespace, ingress.Name, target.Namespace, target.Service, externalName)
+					h.eventf(ingress, corev1.EventTypeWarning, "LinkTargetNotFound",
+						"Service %s/%s, targeted by ExternalName %s, doesn't exist", target.Namespace, target.Service, externalName)
+				})
+				return nil
+			} else if err != nil {
+				return err
+			}
+		} else if svc.Namespace != namespace {
+			continue
+		}
+
+		if len(svc.Spec.Selector) == 0 {
+			h.refuseEmptySelector(warnings.emptySelector, ingress, "ingress", &svc)
+			continue
+		}
+
+		// Try to map each ingress port to a port on the service
+		for _, port := range ports {
+			for _, svcPort := range svc.Spec.Ports {
+				if (svcPort.Name != "" && svcPort.Name == port.Name) || svcPort.Port == port.Number {
+					published = append(published, ingressPort{selector: svc.Spec.Selector, port: uint32(svcPort.TargetPort.IntVal)})
+				}
+			}
+		}
+	}
+
+	for _, p := range published {
+		workloads.add(p.selector, p.port, "Ingress", ingress)
+	}
+	return nil
+}
+
+// isPublishedService returns true for the Services that Acorn creates for published TCP/UDP ports
+func isPublishedService(service *corev1.Service) bool {
+	return service.Spec.Type == corev1.ServiceTypeLoadBalancer || service.Spec.Type == corev1.ServiceTypeNodePort
+}
+
+// workloadPorts maps a workload selector to the ports that need to be PERMISSIVE on the selected pods
+type workloadPorts map[string]*workload
+
+type workload struct {
+	selector map[string]string
+	ports    map[uint32]*v1beta1.PeerAuthentication_MutualTLS
+	// sources are the Ingresses, Services, and AppInstances that publish the ports, keyed by kind and object key
+	sources map[string]*portSource
+}
+
+// portSource is an Ingress, Service, or AppInstance that publishes ports of a workload
+type portSource struct {
+	obj   kclient.Object
+	ports map[uint32]bool
+}
+
+func (p *portSource) sortedPorts() []uint32 {
+	result := make([]uint32, 0, len(p.ports))
+	for port := range p.ports {
+		result = append(result, port)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i] < result[j]
+	})
+	return result
+}
+
+func (w workloadPorts) add(selector map[string]string, port uint32, sourceKind string, source kclient.Object) {
+	key := labels.Set(selector).String()
+	if w[key] == nil {
+		w[key] = &workload{
+			selector: selector,
+			ports:    map[uint32]*v1beta1.PeerAuthentication_MutualTLS{},
+			sources:  map[string]*portSource{},
+		}
+	}
+	w[key].ports[port] = &v1beta1.PeerAuthentication_MutualTLS{
+		Mode: v1beta1.PeerAuthentication_MutualTLS_PERMISSIVE,
+	}
+
+	sourceKey := sourceKind + "/" + toKey(source.GetNamespace(), source.GetName())
+	if w[key].sources[sourceKey] == nil {
+		w[key].sources[sourceKey] = &portSource{
+			obj:   source,
+			ports: map[uint32]bool{},
+		}
+	}
+	w[key].sources[sourceKey].ports[port] = true
+}
+
+// sorted returns the workloads sorted by selector
+func (w workloadPorts) sorted() []*workload {
+	keys := make([]string, 0, len(w))
+	for key := range w {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]*workload, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, w[key])
+	}
+	return result
+}
+
+// peerAuthentication returns the PERMISSIVE PeerAuthentication of the workload, named after a hash of its selector
+func (w *workload) peerAuthentication(namespace string) *securityv1beta1.PeerAuthentication {
+	digest := sha256.Sum256([]byte(labels.Set(w.selector).String()))
+	return &securityv1beta1.PeerAuthentication{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name.SafeConcatName(namespace, "permissive", hex.EncodeToString(digest[:])[:8]),
+			Namespace: namespace,
+			Labels: map[string]string{
+				acornManagedLabel: "true",
+			},
+		},
+		Spec: v1beta1.PeerAuthentication{
+			Selector: &typev1beta1.WorkloadSelector{
+				MatchLabels: w.selector,
+			},
+			PortLevelMtls: w.ports,
+		},
+	}
+}
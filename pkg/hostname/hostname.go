@@ -0,0 +1,73 @@
+// Package hostname classifies hostnames, such as the ExternalNames of Acorn links, as Services of the cluster or
+// external hosts
+package hostname
+
+import (
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// DefaultClusterDomain is the DNS domain of most clusters
+const DefaultClusterDomain = "cluster.local"
+
+type Kind int
+
+const (
+	// Invalid is not a valid DNS name
+	Invalid Kind = iota
+	// ClusterService is the name of a Service in this cluster
+	ClusterService
+	// External is any other host, usually outside the cluster
+	External
+)
+
+// Host is the classification of a hostname, such as the ExternalName of a Service
+type Host struct {
+	Kind Kind
+	// Hostname is normalized: lowercase, without a trailing dot, and fully qualified for Services
+	Hostname string
+	// Service and Namespace are only set for Services in this cluster
+	Service   string
+	Namespace string
+}
+
+// Resolver classifies hostnames as Services of this cluster or external hosts
+type Resolver struct {
+	clusterDomain string
+}
+
+func NewResolver(clusterDomain string) Resolver {
+	return Resolver{
+		clusterDomain: strings.Trim(strings.ToLower(clusterDomain), "."),
+	}
+}
+
+// Resolve classifies the hostname. Services are recognized in the <service>.<namespace>.svc and
+// <service>.<namespace>.svc.<cluster domain> forms, with or without a trailing dot. The <service>.<namespace>
+// short form is an external host: cluster DNS answers ExternalName lookups with a CNAME that clients resolve as is,
+// without their search domains, so it never reaches a Service.
+func (r Resolver) Resolve(hostname string) Host {
+	clusterDomain := r.clusterDomain
+	if clusterDomain == "" {
+		clusterDomain = DefaultClusterDomain
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(hostname)), ".")
+	if host == "" || len(validation.IsDNS1123Subdomain(host)) > 0 {
+		return Host{Kind: Invalid, Hostname: host}
+	}
+
+	labels := strings.SplitN(host, ".", 4)
+	if len(labels) >= 3 && labels[2] == "svc" && (len(labels) == 3 || labels[3] == clusterDomain) &&
+		len(validation.IsDNS1123Label(labels[0])) == 0 && len(validation.IsDNS1123Label(labels[1])) == 0 {
+		return Host{
+			Kind:      ClusterService,
+			Hostname:  strings.Join([]string{labels[0], labels[1], "svc", clusterDomain}, "."),
+			Service:   labels[0],
+			Namespace: labels[1],
+		}
+	}
+
+	return Host{Kind: External, Hostname: host}
+}
@@ -0,0 +1,80 @@
+package hostname
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolver(t *testing.T) {
+	tests := []struct {
+		name          string
+		clusterDomain string
+		hostname      string
+		expected      Host
+	}{
+		{
+			name:     "service with the default cluster domain",
+			hostname: "my-svc.my-ns.svc.cluster.local",
+			expected: Host{Kind: ClusterService, Hostname: "my-svc.my-ns.svc.cluster.local", Service: "my-svc", Namespace: "my-ns"},
+		},
+		{
+			name:     "service FQDN with a trailing dot",
+			hostname: "my-svc.my-ns.svc.cluster.local.",
+			expected: Host{Kind: ClusterService, Hostname: "my-svc.my-ns.svc.cluster.local", Service: "my-svc", Namespace: "my-ns"},
+		},
+		{
+			name:     "service without the cluster domain",
+			hostname: "my-svc.my-ns.svc",
+			expected: Host{Kind: ClusterService, Hostname: "my-svc.my-ns.svc.cluster.local", Service: "my-svc", Namespace: "my-ns"},
+		},
+		{
+			name:          "service with a custom cluster domain",
+			clusterDomain: "k8s.example.internal.",
+			hostname:      "My-Svc.my-ns.svc.K8s.Example.Internal",
+			expected:      Host{Kind: ClusterService, Hostname: "my-svc.my-ns.svc.k8s.example.internal", Service: "my-svc", Namespace: "my-ns"},
+		},
+		{
+			name:          "service of another cluster domain",
+			clusterDomain: "k8s.example.internal",
+			hostname:      "my-svc.my-ns.svc.cluster.local",
+			expected:      Host{Kind: External, Hostname: "my-svc.my-ns.svc.cluster.local"},
+		},
+		{
+			name:     "short form is not resolved by cluster DNS",
+			hostname: "my-svc.my-ns",
+			expected: Host{Kind: External, Hostname: "my-svc.my-ns"},
+		},
+		{
+			name:     "external host",
+			hostname: "api.payments.example.com",
+			expected: Host{Kind: External, Hostname: "api.payments.example.com"},
+		},
+		{
+			name:     "external host with svc label",
+			hostname: "api.svc.example.com",
+			expected: Host{Kind: External, Hostname: "api.svc.example.com"},
+		},
+		{
+			name:     "single label",
+			hostname: "localhost",
+			expected: Host{Kind: External, Hostname: "localhost"},
+		},
+		{
+			name:     "empty",
+			hostname: "",
+			expected: Host{Kind: Invalid},
+		},
+		{
+			name:     "invalid characters",
+			hostname: "my_svc.my-ns.svc.cluster.local",
+			expected: Host{Kind: Invalid, Hostname: "my_svc.my-ns.svc.cluster.local"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, NewResolver(tt.clusterDomain).Resolve(tt.hostname))
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+const namespace = "acorn_istio_plugin"
+
+var (
+	Registry = prometheus.NewRegistry()
+
+	// RefusedPolicies counts the port-level policies that were not generated because the
+	// workload selector would have been empty, which Istio treats as namespace-wide. Each refusal
+	// is counted once, until the Service gets a selector or is no longer targeted.
+	RefusedPolicies = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "refused_policies_total",
+		Help:      "Number of port-level policies that were refused because they had an empty workload selector.",
+	}, []string{"source"})
+
+	// DriftDetected counts the managed objects that were found modified outside of the plugin, by kind and by
+	// what the plugin did about it.
+	DriftDetected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "drift_detected_total",
+		Help:      "Number of times a managed object was found modified outside of the plugin.",
+	}, []string{"kind", "action"})
+
+	// DriftedObjects is the number of managed objects that currently differ from the state generated by the plugin.
+	DriftedObjects = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "drifted_objects",
+		Help:      "Number of managed objects that currently differ from the state generated by the plugin.",
+	}, []string{"kind"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		RefusedPolicies,
+		DriftDetected,
+		DriftedObjects,
+	)
+}
+
+// Serve exposes the metrics on the given address until the context is done. An empty address disables it.
+func Serve(ctx context.Context, address string) {
+	if address == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Errorf("Failed to serve metrics on %s: %v", address, err)
+		}
+	}()
+}
@@ -0,0 +1,90 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// ConfigMapName is the name of the ConfigMap, in the plugin's namespace, that records the schema version
+	ConfigMapName = "acorn-istio-plugin-schema"
+	versionKey    = "version"
+)
+
+// Migration upgrades the objects left by an earlier version of the plugin. A migration that fails or is interrupted
+// runs again on the next start, so it must be idempotent.
+type Migration struct {
+	// Version is the schema version that the migration upgrades to, starting at 1
+	Version     int
+	Description string
+	// Migrate returns a description of each change that it made
+	Migrate func(ctx context.Context, c kclient.Client) ([]string, error)
+}
+
+// Run applies the migrations whose version is newer than the schema version recorded in the ConfigMap, in order, and
+// records the new version after each one
+func Run(ctx context.Context, c kclient.Client, namespace string, migrations []Migration) error {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return fmt.Errorf("migration %q has version %d, expected %d", m.Description, m.Version, i+1)
+		}
+	}
+
+	configMap := &corev1.ConfigMap{}
+	err := c.Get(ctx, kclient.ObjectKey{Namespace: namespace, Name: ConfigMapName}, configMap)
+	if apierror.IsNotFound(err) {
+		configMap = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      ConfigMapName,
+				Namespace: namespace,
+			},
+		}
+	} else if err != nil {
+		return err
+	}
+
+	version := 0
+	if v, ok := configMap.Data[versionKey]; ok {
+		version, err = strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid schema version %q in ConfigMap %s/%s: %w", v, namespace, ConfigMapName, err)
+		}
+	}
+	if version > len(migrations) {
+		logrus.Warnf("Schema version %d is newer than the latest version %d known to this plugin, skipping migrations", version, len(migrations))
+		return nil
+	}
+
+	// Migrations are logged as warnings so that they show up at the default log level of the plugin
+	for _, m := range migrations[version:] {
+		logrus.Warnf("Migrating to schema version %d: %s", m.Version, m.Description)
+		changes, err := m.Migrate(ctx, c)
+		for _, change := range changes {
+			logrus.Warnf("Schema version %d: %s", m.Version, change)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to migrate to schema version %d: %w", m.Version, err)
+		}
+
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		configMap.Data[versionKey] = strconv.Itoa(m.Version)
+		if configMap.ResourceVersion == "" {
+			err = c.Create(ctx, configMap)
+		} else {
+			err = c.Update(ctx, configMap)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to record schema version %d: %w", m.Version, err)
+		}
+	}
+	return nil
+}
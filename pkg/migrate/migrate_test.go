@@ -0,0 +1,90 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/acorn-io/acorn-istio-plugin/pkg/scheme"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRun(t *testing.T) {
+	var ran []int
+	migration := func(version int, err error) Migration {
+		return Migration{
+			Version:     version,
+			Description: fmt.Sprintf("migration %d", version),
+			Migrate: func(ctx context.Context, c kclient.Client) ([]string, error) {
+				ran = append(ran, version)
+				return nil, err
+			},
+		}
+	}
+	version := func(c kclient.Client) string {
+		configMap := &corev1.ConfigMap{}
+		if err := c.Get(context.Background(), kclient.ObjectKey{Namespace: "acorn-istio-plugin", Name: ConfigMapName}, configMap); err != nil {
+			t.Fatal(err)
+		}
+		return configMap.Data[versionKey]
+	}
+
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ConfigMapName,
+			Namespace: "acorn-istio-plugin",
+		},
+		Data: map[string]string{versionKey: "1"},
+	}).Build()
+
+	// Migrations that were already applied are skipped, and a failed one stops the rest
+	failed := errors.New("failed")
+	err := Run(context.Background(), c, "acorn-istio-plugin", []Migration{migration(1, nil), migration(2, nil), migration(3, failed), migration(4, nil)})
+	assert.ErrorIs(t, err, failed)
+	assert.Equal(t, []int{2, 3}, ran)
+	assert.Equal(t, "2", version(c))
+
+	// The failed migration runs again
+	ran = nil
+	err = Run(context.Background(), c, "acorn-istio-plugin", []Migration{migration(1, nil), migration(2, nil), migration(3, nil), migration(4, nil)})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{3, 4}, ran)
+	assert.Equal(t, "4", version(c))
+
+	// A newer schema is left alone
+	ran = nil
+	err = Run(context.Background(), c, "acorn-istio-plugin", []Migration{migration(1, nil)})
+	assert.NoError(t, err)
+	assert.Empty(t, ran)
+	assert.Equal(t, "4", version(c))
+}
+
+func TestRunFirstStart(t *testing.T) {
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).Build()
+
+	err := Run(context.Background(), c, "acorn-istio-plugin", []Migration{{
+		Version: 1,
+		Migrate: func(ctx context.Context, c kclient.Client) ([]string, error) {
+			return []string{"changed"}, nil
+		},
+	}})
+	assert.NoError(t, err)
+
+	configMap := &corev1.ConfigMap{}
+	if err := c.Get(context.Background(), kclient.ObjectKey{Namespace: "acorn-istio-plugin", Name: ConfigMapName}, configMap); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1", configMap.Data[versionKey])
+}
+
+func TestRunOutOfOrder(t *testing.T) {
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).Build()
+
+	err := Run(context.Background(), c, "acorn-istio-plugin", []Migration{{Version: 2}})
+	assert.EqualError(t, err, `migration "" has version 2, expected 1`)
+}
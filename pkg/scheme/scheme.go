@@ -1,6 +1,7 @@
 package scheme
 
 import (
+	acornv1 "github.com/acorn-io/acorn-istio-plugin/pkg/apis/acorn/v1"
 	"github.com/rancher/wrangler/pkg/merr"
 	networkingv1beta1 "istio.io/client-go/pkg/apis/networking/v1beta1"
 	securityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
@@ -35,6 +36,7 @@ func AddToScheme(scheme *runtime.Scheme) error {
 	errs = append(errs, apiextensionv1.AddToScheme(scheme))
 	errs = append(errs, securityv1beta1.AddToScheme(scheme))
 	errs = append(errs, networkingv1beta1.AddToScheme(scheme))
+	errs = append(errs, acornv1.AddToScheme(scheme))
 	return merr.NewErrors(errs...)
 }
 
@@ -0,0 +1,68 @@
+package self
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+	serviceAccountTokenFile     = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+// PodName returns the name of the plugin's pod, from the POD_NAME environment variable or the hostname
+func PodName() (string, error) {
+	if podName := os.Getenv("POD_NAME"); podName != "" {
+		return podName, nil
+	}
+	return os.Hostname()
+}
+
+// Namespace returns the namespace of the plugin's pod, from the POD_NAMESPACE environment variable or the
+// namespace of the mounted service account
+func Namespace() (string, error) {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace, nil
+	}
+
+	namespace, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the namespace of the plugin's pod: %w", err)
+	}
+	return strings.TrimSpace(string(namespace)), nil
+}
+
+// Username returns the name with which the plugin authenticates to the API server, from the SERVICE_ACCOUNT_USERNAME
+// environment variable or the subject of the mounted service account token
+func Username() (string, error) {
+	if username := os.Getenv("SERVICE_ACCOUNT_USERNAME"); username != "" {
+		return username, nil
+	}
+
+	token, err := os.ReadFile(serviceAccountTokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the service account of the plugin's pod: %w", err)
+	}
+	parts := strings.Split(strings.TrimSpace(string(token)), ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid service account token in %s", serviceAccountTokenFile)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid service account token in %s: %w", serviceAccountTokenFile, err)
+	}
+
+	claims := struct {
+		Subject string `json:"sub"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("invalid service account token in %s: %w", serviceAccountTokenFile, err)
+	}
+	if claims.Subject == "" {
+		return "", fmt.Errorf("the service account token in %s has no subject", serviceAccountTokenFile)
+	}
+	return claims.Subject, nil
+}
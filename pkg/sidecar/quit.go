@@ -0,0 +1,71 @@
+package sidecar
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// PilotAgentQuitURL makes pilot-agent drain and stop Envoy, then exit itself
+	PilotAgentQuitURL = "http://localhost:15020/quitquitquit"
+	// EnvoyQuitURL stops Envoy directly, which pilot-agent then follows. It is used when pilot-agent doesn't answer.
+	EnvoyQuitURL = "http://localhost:15000/quitquitquit"
+)
+
+type QuitOptions struct {
+	// URLs are tried in order on every attempt, until one of them accepts the request
+	URLs          []string
+	RetryInterval time.Duration
+	Timeout       time.Duration
+}
+
+// Quit asks the Istio proxy running in the same pod to shut down, retrying until one of the endpoints accepts
+// the request or the timeout expires.
+func Quit(ctx context.Context, opts QuitOptions) error {
+	if len(opts.URLs) == 0 {
+		opts.URLs = []string{PilotAgentQuitURL, EnvoyQuitURL}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	for {
+		var lastErr error
+		for _, url := range opts.URLs {
+			if lastErr = post(ctx, client, url); lastErr == nil {
+				logrus.Infof("Istio proxy accepted shutdown request on %s", url)
+				return nil
+			}
+			logrus.Warnf("Failed to shut down Istio proxy using %s: %v", url, lastErr)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("giving up on shutting down Istio proxy: %w", lastErr)
+		case <-time.After(opts.RetryInterval):
+		}
+	}
+}
+
+func post(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package sidecar
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuit(t *testing.T) {
+	var pilotAgentCalls, envoyCalls atomic.Int32
+	pilotAgent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pilotAgentCalls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer pilotAgent.Close()
+	envoy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Envoy only accepts the request on the second attempt
+		if envoyCalls.Add(1) == 1 || r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer envoy.Close()
+
+	err := Quit(context.Background(), QuitOptions{
+		URLs:          []string{pilotAgent.URL, envoy.URL},
+		RetryInterval: time.Millisecond,
+		Timeout:       time.Minute,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), pilotAgentCalls.Load())
+	assert.Equal(t, int32(2), envoyCalls.Load())
+}
+
+func TestQuitTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	err := Quit(context.Background(), QuitOptions{
+		URLs:          []string{server.URL},
+		RetryInterval: 10 * time.Millisecond,
+		Timeout:       50 * time.Millisecond,
+	})
+	assert.Error(t, err)
+}
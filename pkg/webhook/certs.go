@@ -0,0 +1,183 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	caCertKey = "ca.crt"
+
+	certValidity = 10 * 365 * 24 * time.Hour
+	// certRenewBefore is how long before it expires a certificate is replaced
+	certRenewBefore = 30 * 24 * time.Hour
+)
+
+// certificate is the serving certificate of the webhook server, along with the CA that the API server uses to verify it
+type certificate struct {
+	caPEM   []byte
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// ensureCertificate returns the serving certificate stored in the Secret, or generates a new one if the Secret doesn't
+// exist or if its certificate doesn't match the Service or is about to expire. Storing the certificate in a Secret
+// lets every replica of the plugin serve the same certificate.
+func ensureCertificate(ctx context.Context, k8s kubernetes.Interface, namespace, secretName, serviceName string) (*certificate, error) {
+	dnsNames := serviceDNSNames(namespace, serviceName)
+
+	secret, err := k8s.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	if err != nil && !apierror.IsNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		cert := &certificate{
+			caPEM:   secret.Data[caCertKey],
+			certPEM: secret.Data[corev1.TLSCertKey],
+			keyPEM:  secret.Data[corev1.TLSPrivateKeyKey],
+		}
+		if cert.valid(dnsNames[len(dnsNames)-1]) {
+			return cert, nil
+		}
+	}
+
+	logrus.Infof("Generating webhook serving certificate for service %s/%s", namespace, serviceName)
+	cert, err := generateCertificate(dnsNames)
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string][]byte{
+		caCertKey:               cert.caPEM,
+		corev1.TLSCertKey:       cert.certPEM,
+		corev1.TLSPrivateKeyKey: cert.keyPEM,
+	}
+	if secret != nil && secret.Name != "" {
+		secret.Data = data
+		_, err = k8s.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	} else {
+		_, err = k8s.CoreV1().Secrets(namespace).Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      secretName,
+				Namespace: namespace,
+			},
+			Type: corev1.SecretTypeTLS,
+			Data: data,
+		}, metav1.CreateOptions{})
+	}
+	if apierror.IsAlreadyExists(err) || apierror.IsConflict(err) {
+		// Another replica stored its certificate first, use that one
+		return ensureCertificate(ctx, k8s, namespace, secretName, serviceName)
+	}
+	return cert, err
+}
+
+// valid returns true if the certificate is signed by the CA, is valid for the DNS name, and doesn't expire soon
+func (c *certificate) valid(dnsName string) bool {
+	if _, err := tls.X509KeyPair(c.certPEM, c.keyPEM); err != nil {
+		return false
+	}
+
+	block, _ := pem.Decode(c.certPEM)
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(c.caPEM) {
+		return false
+	}
+	_, err = cert.Verify(x509.VerifyOptions{
+		DNSName:     dnsName,
+		Roots:       roots,
+		CurrentTime: time.Now().Add(certRenewBefore),
+	})
+	return err == nil
+}
+
+func generateCertificate(dnsNames []string) (*certificate, error) {
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := notBefore.Add(certValidity)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "acorn-istio-plugin-webhook-ca"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: dnsNames[len(dnsNames)-1]},
+		DNSNames:     dnsNames,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &certificate{
+		caPEM:   encodePEM("CERTIFICATE", caDER),
+		certPEM: encodePEM("CERTIFICATE", certDER),
+		keyPEM:  encodePEM("EC PRIVATE KEY", keyDER),
+	}, nil
+}
+
+func encodePEM(blockType string, der []byte) []byte {
+	buf := &bytes.Buffer{}
+	_ = pem.Encode(buf, &pem.Block{Type: blockType, Bytes: der})
+	return buf.Bytes()
+}
+
+// serviceDNSNames returns the names under which the API server can reach the Service, the last one being
+// the name that it actually uses
+func serviceDNSNames(namespace, serviceName string) []string {
+	return []string{
+		serviceName,
+		fmt.Sprintf("%s.%s", serviceName, namespace),
+		fmt.Sprintf("%s.%s.svc", serviceName, namespace),
+	}
+}
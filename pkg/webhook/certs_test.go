@@ -0,0 +1,35 @@
+package webhook
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEnsureCertificate(t *testing.T) {
+	k8s := fake.NewSimpleClientset()
+
+	cert, err := ensureCertificate(context.Background(), k8s, "acorn-istio-plugin", "istio-plugin-controller-webhook-tls", "istio-plugin-controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, cert.valid("istio-plugin-controller.acorn-istio-plugin.svc"))
+	assert.False(t, cert.valid("istio-plugin-controller.other-namespace.svc"))
+
+	// The certificate stored in the Secret is reused
+	again, err := ensureCertificate(context.Background(), k8s, "acorn-istio-plugin", "istio-plugin-controller-webhook-tls", "istio-plugin-controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, cert, again)
+
+	// It is replaced when the Service is renamed
+	moved, err := ensureCertificate(context.Background(), k8s, "acorn-istio-plugin", "istio-plugin-controller-webhook-tls", "other-controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, cert, moved)
+	assert.True(t, moved.valid("other-controller.acorn-istio-plugin.svc"))
+}
@@ -0,0 +1,126 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// proxyConfigAnnotation is read by the Istio sidecar injector, and overrides the mesh-wide proxy config for the pod
+	proxyConfigAnnotation = "proxy.istio.io/config"
+	holdApplicationKey    = "holdApplicationUntilProxyStarts"
+
+	// HoldApplicationAnnotation can be set to "false" on an Acorn app (or its pods) to opt out of holding the
+	// application until the proxy starts
+	HoldApplicationAnnotation = "acorn.io/istio-hold-application-until-proxy-starts"
+
+	holdApplicationPath = "/hold-application-until-proxy-starts"
+)
+
+// HoldApplicationUntilProxyStarts returns a webhook that sets holdApplicationUntilProxyStarts in the proxy config of
+// the pods of Acorn apps, so that their containers only start once the Istio proxy is ready to carry their traffic.
+// The API server calls mutating webhooks in the order of their configuration names, so this one runs before the
+// Istio sidecar injector that reads the annotation.
+func HoldApplicationUntilProxyStarts(k8s kubernetes.Interface) Webhook {
+	return podWebhook("hold-application.istio-plugin.acorn.io", holdApplicationPath,
+		func(ctx context.Context, req *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, error) {
+			return holdApplication(ctx, k8s, req)
+		})
+}
+
+// podWebhook returns a webhook that is called when the pods of Acorn apps are created. Failures are ignored, so that
+// pods can still be created while the plugin is down.
+func podWebhook(name, path string, handler HandlerFunc) Webhook {
+	failurePolicy := admissionregistrationv1.Ignore
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	timeoutSeconds := int32(5)
+
+	return Webhook{
+		Path:    path,
+		Handler: handler,
+		Mutating: &admissionregistrationv1.MutatingWebhook{
+			Name: name,
+			Rules: []admissionregistrationv1.RuleWithOperations{{
+				Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+				Rule: admissionregistrationv1.Rule{
+					APIGroups:   []string{""},
+					APIVersions: []string{"v1"},
+					Resources:   []string{"pods"},
+				},
+			}},
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{
+					Key:      "acorn.io/app-namespace",
+					Operator: metav1.LabelSelectorOpExists,
+				}},
+			},
+			ObjectSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"acorn.io/managed": "true",
+				},
+			},
+			FailurePolicy:           &failurePolicy,
+			SideEffects:             &sideEffects,
+			TimeoutSeconds:          &timeoutSeconds,
+			AdmissionReviewVersions: []string{"v1"},
+		},
+	}
+}
+
+func holdApplication(ctx context.Context, k8s kubernetes.Interface, req *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, error) {
+	pod := corev1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		return nil, err
+	}
+
+	if optedOut(pod.Annotations) {
+		return nil, nil
+	}
+	namespace, err := k8s.CoreV1().Namespaces().Get(ctx, req.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if optedOut(namespace.Annotations) {
+		return nil, nil
+	}
+
+	proxyConfig, changed, err := withHoldApplication(pod.Annotations[proxyConfigAnnotation])
+	if err != nil || !changed {
+		return nil, err
+	}
+
+	return annotationsPatch(pod.Annotations, map[string]string{proxyConfigAnnotation: proxyConfig})
+}
+
+func optedOut(annotations map[string]string) bool {
+	return annotations[HoldApplicationAnnotation] == "false"
+}
+
+// withHoldApplication returns the proxy config with holdApplicationUntilProxyStarts enabled, unless the proxy config
+// already sets it, in which case it is left alone
+func withHoldApplication(proxyConfig string) (string, bool, error) {
+	config := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(proxyConfig), &config); err != nil {
+		return "", false, err
+	}
+	if config == nil {
+		config = map[string]interface{}{}
+	}
+	if _, ok := config[holdApplicationKey]; ok {
+		return proxyConfig, false, nil
+	}
+
+	config[holdApplicationKey] = true
+	result, err := yaml.Marshal(config)
+	if err != nil {
+		return "", false, err
+	}
+	return string(result), true, nil
+}
@@ -0,0 +1,89 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestHoldApplication(t *testing.T) {
+	tests := []struct {
+		name                 string
+		podAnnotations       map[string]string
+		namespaceAnnotations map[string]string
+		expectedPatch        string
+	}{
+		{
+			name:          "no annotations",
+			expectedPatch: `[{"op":"add","path":"/metadata/annotations","value":{"proxy.istio.io/config":"holdApplicationUntilProxyStarts: true\n"}}]`,
+		},
+		{
+			name: "existing proxy config",
+			podAnnotations: map[string]string{
+				proxyConfigAnnotation: "concurrency: 2\n",
+			},
+			expectedPatch: `[{"op":"add","path":"/metadata/annotations/proxy.istio.io~1config","value":"concurrency: 2\nholdApplicationUntilProxyStarts: true\n"}]`,
+		},
+		{
+			name: "explicitly disabled in the proxy config",
+			podAnnotations: map[string]string{
+				proxyConfigAnnotation: "holdApplicationUntilProxyStarts: false\n",
+			},
+		},
+		{
+			name: "pod opted out",
+			podAnnotations: map[string]string{
+				HoldApplicationAnnotation: "false",
+			},
+		},
+		{
+			name: "app opted out",
+			namespaceAnnotations: map[string]string{
+				HoldApplicationAnnotation: "false",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k8s := fake.NewSimpleClientset(&corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "my-app-namespace",
+					Annotations: tt.namespaceAnnotations,
+				},
+			})
+			pod, err := json.Marshal(&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "my-app-pod",
+					Namespace:   "my-app-namespace",
+					Annotations: tt.podAnnotations,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := holdApplication(context.Background(), k8s, &admissionv1.AdmissionRequest{
+				Namespace: "my-app-namespace",
+				Object:    runtime.RawExtension{Raw: pod},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.expectedPatch == "" {
+				assert.Nil(t, resp)
+				return
+			}
+			assert.True(t, resp.Allowed)
+			assert.JSONEq(t, tt.expectedPatch, string(resp.Patch))
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	securityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// BreakGlassAnnotation can be set to "true" on an object to modify or delete it despite the protection of the
+	// objects managed by the plugin. Setting it is itself allowed.
+	BreakGlassAnnotation = "acorn.io/istio-plugin-break-glass"
+
+	protectManagedResourcesPath       = "/protect-managed-resources"
+	protectAppPeerAuthenticationsPath = "/protect-app-peer-authentications"
+	kubeSystemServiceAccountPrefix    = "system:serviceaccount:kube-system:"
+	kubeControllerManagerUsername     = "system:kube-controller-manager"
+)
+
+// ProtectManagedResources returns a webhook that rejects the changes and deletions of the PeerAuthentications,
+// AuthorizationPolicies, and VirtualServices generated by the plugin, unless they are made by the plugin itself or
+// the object has the break-glass annotation. The controllers of kube-system are allowed too, so that app namespaces
+// can still be deleted.
+func ProtectManagedResources(pluginUsername string) Webhook {
+	return validatingWebhook("managed-resources.istio-plugin.acorn.io", protectManagedResourcesPath,
+		func(ctx context.Context, req *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, error) {
+			return protectManagedResource(pluginUsername, req)
+		},
+		admissionregistrationv1.ValidatingWebhook{
+			Rules: []admissionregistrationv1.RuleWithOperations{
+				{
+					Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Update, admissionregistrationv1.Delete},
+					Rule: admissionregistrationv1.Rule{
+						APIGroups:   []string{"security.istio.io"},
+						APIVersions: []string{"*"},
+						Resources:   []string{"peerauthentications", "authorizationpolicies"},
+					},
+				},
+				{
+					Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Update, admissionregistrationv1.Delete},
+					Rule: admissionregistrationv1.Rule{
+						APIGroups:   []string{"networking.istio.io"},
+						APIVersions: []string{"*"},
+						Resources:   []string{"virtualservices"},
+					},
+				},
+			},
+			ObjectSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"acorn.io/managed": "true",
+				},
+			},
+		})
+}
+
+// ProtectAppPeerAuthentications returns a webhook that rejects namespace-wide PeerAuthentications in the namespaces
+// of Acorn apps, other than the one generated by the plugin. Istio only applies the oldest namespace-wide
+// PeerAuthentication, so another one could silently replace the STRICT policy of the app.
+func ProtectAppPeerAuthentications(pluginUsername string) Webhook {
+	return validatingWebhook("app-peer-authentications.istio-plugin.acorn.io", protectAppPeerAuthenticationsPath,
+		func(ctx context.Context, req *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, error) {
+			return protectAppPeerAuthentication(pluginUsername, req)
+		},
+		admissionregistrationv1.ValidatingWebhook{
+			Rules: []admissionregistrationv1.RuleWithOperations{{
+				Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+				Rule: admissionregistrationv1.Rule{
+					APIGroups:   []string{"security.istio.io"},
+					APIVersions: []string{"*"},
+					Resources:   []string{"peerauthentications"},
+				},
+			}},
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{
+					Key:      "acorn.io/app-namespace",
+					Operator: metav1.LabelSelectorOpExists,
+				}},
+			},
+		})
+}
+
+// validatingWebhook fills in the settings shared by the validating webhooks of the plugin. Failures are ignored, so
+// that the objects can still be changed while the plugin is down.
+func validatingWebhook(name, path string, handler HandlerFunc, webhook admissionregistrationv1.ValidatingWebhook) Webhook {
+	failurePolicy := admissionregistrationv1.Ignore
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	timeoutSeconds := int32(5)
+
+	webhook.Name = name
+	webhook.FailurePolicy = &failurePolicy
+	webhook.SideEffects = &sideEffects
+	webhook.TimeoutSeconds = &timeoutSeconds
+	webhook.AdmissionReviewVersions = []string{"v1"}
+	return Webhook{
+		Path:       path,
+		Handler:    handler,
+		Validating: &webhook,
+	}
+}
+
+func protectManagedResource(pluginUsername string, req *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, error) {
+	allowed, err := allowedToBypass(pluginUsername, req)
+	if err != nil || allowed {
+		return nil, err
+	}
+
+	verb := "modified"
+	if req.Operation == admissionv1.Delete {
+		verb = "deleted"
+	}
+	return deny(fmt.Sprintf("%s %s/%s is managed by the Acorn Istio plugin and can't be %s. Set the %s: \"true\" annotation to override.",
+		req.Kind.Kind, req.Namespace, req.Name, verb, BreakGlassAnnotation)), nil
+}
+
+func protectAppPeerAuthentication(pluginUsername string, req *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, error) {
+	pa := securityv1beta1.PeerAuthentication{}
+	if err := json.Unmarshal(req.Object.Raw, &pa); err != nil {
+		return nil, fmt.Errorf("failed to decode PeerAuthentication %s/%s: %w", req.Namespace, req.Name, err)
+	}
+	if pa.Spec.Selector != nil && len(pa.Spec.Selector.MatchLabels) > 0 {
+		return nil, nil
+	}
+
+	allowed, err := allowedToBypass(pluginUsername, req)
+	if err != nil || allowed {
+		return nil, err
+	}
+	return deny(fmt.Sprintf("namespace %s belongs to an Acorn app, whose namespace-wide PeerAuthentication is managed by the Acorn Istio plugin. "+
+		"Add a selector to PeerAuthentication %s, or set the %s: \"true\" annotation to override.",
+		req.Namespace, req.Name, BreakGlassAnnotation)), nil
+}
+
+// allowedToBypass returns true if the request comes from the plugin or a controller of kube-system, or if the old or
+// the new object has the break-glass annotation
+func allowedToBypass(pluginUsername string, req *admissionv1.AdmissionRequest) (bool, error) {
+	username := req.UserInfo.Username
+	if username == pluginUsername || username == kubeControllerManagerUsername ||
+		strings.HasPrefix(username, kubeSystemServiceAccountPrefix) {
+		return true, nil
+	}
+
+	for _, raw := range [][]byte{req.Object.Raw, req.OldObject.Raw} {
+		if len(raw) == 0 {
+			continue
+		}
+		obj := metav1.PartialObjectMetadata{}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return false, fmt.Errorf("failed to decode %s %s/%s: %w", req.Kind.Kind, req.Namespace, req.Name, err)
+		}
+		if obj.Annotations[BreakGlassAnnotation] == "true" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func deny(message string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusForbidden,
+			Reason:  metav1.StatusReasonForbidden,
+			Message: message,
+		},
+	}
+}
@@ -0,0 +1,186 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"istio.io/api/type/v1beta1"
+	securityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const pluginUsername = "system:serviceaccount:acorn-istio-plugin:istio-plugin-controller"
+
+func rawPeerAuthentication(t *testing.T, annotations, selector map[string]string) runtime.RawExtension {
+	pa := &securityv1beta1.PeerAuthentication{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "policy",
+			Namespace:   "my-app-namespace",
+			Annotations: annotations,
+		},
+	}
+	if selector != nil {
+		pa.Spec.Selector = &v1beta1.WorkloadSelector{MatchLabels: selector}
+	}
+	raw, err := json.Marshal(pa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runtime.RawExtension{Raw: raw}
+}
+
+func TestProtectManagedResource(t *testing.T) {
+	breakGlass := map[string]string{BreakGlassAnnotation: "true"}
+
+	tests := []struct {
+		name           string
+		username       string
+		operation      admissionv1.Operation
+		oldAnnotations map[string]string
+		newAnnotations map[string]string
+		allowed        bool
+	}{
+		{
+			name:      "update by a user",
+			username:  "alice",
+			operation: admissionv1.Update,
+		},
+		{
+			name:      "delete by a user",
+			username:  "alice",
+			operation: admissionv1.Delete,
+		},
+		{
+			name:      "update by the plugin",
+			username:  pluginUsername,
+			operation: admissionv1.Update,
+			allowed:   true,
+		},
+		{
+			name:      "delete by the namespace controller",
+			username:  "system:serviceaccount:kube-system:namespace-controller",
+			operation: admissionv1.Delete,
+			allowed:   true,
+		},
+		{
+			name:           "update setting the break-glass annotation",
+			username:       "alice",
+			operation:      admissionv1.Update,
+			newAnnotations: breakGlass,
+			allowed:        true,
+		},
+		{
+			name:           "delete with the break-glass annotation",
+			username:       "alice",
+			operation:      admissionv1.Delete,
+			oldAnnotations: breakGlass,
+			allowed:        true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &admissionv1.AdmissionRequest{
+				Kind:      metav1.GroupVersionKind{Group: "security.istio.io", Version: "v1beta1", Kind: "PeerAuthentication"},
+				Namespace: "my-app-namespace",
+				Name:      "policy",
+				Operation: tt.operation,
+				UserInfo:  authenticationv1.UserInfo{Username: tt.username},
+				OldObject: rawPeerAuthentication(t, tt.oldAnnotations, nil),
+			}
+			if tt.operation != admissionv1.Delete {
+				req.Object = rawPeerAuthentication(t, tt.newAnnotations, nil)
+			}
+
+			resp, err := protectManagedResource(pluginUsername, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.allowed {
+				assert.Nil(t, resp)
+				return
+			}
+			assert.False(t, resp.Allowed)
+			assert.Contains(t, resp.Result.Message, "PeerAuthentication my-app-namespace/policy is managed by the Acorn Istio plugin")
+		})
+	}
+}
+
+func TestProtectAppPeerAuthentication(t *testing.T) {
+	tests := []struct {
+		name        string
+		username    string
+		annotations map[string]string
+		selector    map[string]string
+		allowed     bool
+	}{
+		{
+			name:     "namespace-wide policy",
+			username: "alice",
+		},
+		{
+			name:     "workload policy",
+			username: "alice",
+			selector: map[string]string{"app": "web"},
+			allowed:  true,
+		},
+		{
+			name:     "namespace-wide policy of the plugin",
+			username: pluginUsername,
+			allowed:  true,
+		},
+		{
+			name:        "namespace-wide policy with the break-glass annotation",
+			username:    "alice",
+			annotations: map[string]string{BreakGlassAnnotation: "true"},
+			allowed:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := protectAppPeerAuthentication(pluginUsername, &admissionv1.AdmissionRequest{
+				Namespace: "my-app-namespace",
+				Name:      "policy",
+				Operation: admissionv1.Create,
+				UserInfo:  authenticationv1.UserInfo{Username: tt.username},
+				Object:    rawPeerAuthentication(t, tt.annotations, tt.selector),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.allowed {
+				assert.Nil(t, resp)
+				return
+			}
+			assert.False(t, resp.Allowed)
+		})
+	}
+}
+
+func TestProtectDecodeErrorIgnored(t *testing.T) {
+	invalid := runtime.RawExtension{Raw: []byte(`{"metadata": "invalid"}`)}
+
+	// Objects that can't be decoded are an HTTP error, to which the API server applies the Ignore failure policy,
+	// rather than a denial
+	for _, webhook := range []Webhook{ProtectManagedResources(pluginUsername), ProtectAppPeerAuthentications(pluginUsername)} {
+		t.Run(webhook.Path, func(t *testing.T) {
+			recorder := serveReview(t, webhook.Handler, &admissionv1.AdmissionRequest{
+				Namespace: "my-app-namespace",
+				Name:      "policy",
+				Operation: admissionv1.Update,
+				UserInfo:  authenticationv1.UserInfo{Username: "alice"},
+				Object:    invalid,
+				OldObject: invalid,
+			})
+			assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+			assert.Equal(t, admissionregistrationv1.Ignore, *webhook.Validating.FailurePolicy)
+		})
+	}
+}
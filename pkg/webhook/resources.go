@@ -0,0 +1,112 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const proxyResourcesPath = "/proxy-resources"
+
+// ProxyResourceAnnotations maps the annotations that set the resources of an app's Istio proxy to the pod annotations
+// that the Istio sidecar injector reads
+var ProxyResourceAnnotations = map[string]string{
+	"acorn.io/istio-proxy-cpu":          "sidecar.istio.io/proxyCPU",
+	"acorn.io/istio-proxy-cpu-limit":    "sidecar.istio.io/proxyCPULimit",
+	"acorn.io/istio-proxy-memory":       "sidecar.istio.io/proxyMemory",
+	"acorn.io/istio-proxy-memory-limit": "sidecar.istio.io/proxyMemoryLimit",
+}
+
+// ProxyResources returns a webhook that sets the CPU and memory requests and limits of the Istio proxy on the pods of
+// Acorn apps. The values come from the annotations of the app's namespace, which Acorn propagates from the app, and
+// fall back to the given defaults, which are keyed by the same annotations. Values that the pod already sets are kept.
+func ProxyResources(k8s kubernetes.Interface, defaults map[string]string) Webhook {
+	return podWebhook("proxy-resources.istio-plugin.acorn.io", proxyResourcesPath,
+		func(ctx context.Context, req *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, error) {
+			return proxyResources(ctx, k8s, defaults, req)
+		})
+}
+
+func proxyResources(ctx context.Context, k8s kubernetes.Interface, defaults map[string]string, req *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, error) {
+	pod := corev1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		return nil, err
+	}
+
+	namespace, err := k8s.CoreV1().Namespaces().Get(ctx, req.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	annotations := map[string]string{}
+	for appAnnotation, podAnnotation := range ProxyResourceAnnotations {
+		if _, ok := pod.Annotations[podAnnotation]; ok {
+			continue
+		}
+
+		value, ok := namespace.Annotations[appAnnotation]
+		if ok {
+			if _, err := resource.ParseQuantity(value); err != nil {
+				logrus.Warnf("Ignoring invalid value %q of annotation %s on namespace %s", value, appAnnotation, namespace.Name)
+				ok = false
+			}
+		}
+		if !ok {
+			value = defaults[appAnnotation]
+		}
+		if value != "" {
+			annotations[podAnnotation] = value
+		}
+	}
+
+	return annotationsPatch(pod.Annotations, annotations)
+}
+
+// annotationsPatch returns a response that adds the annotations to the pod, or nil if there is nothing to add
+func annotationsPatch(existing, annotations map[string]string) (*admissionv1.AdmissionResponse, error) {
+	if len(annotations) == 0 {
+		return nil, nil
+	}
+
+	var patch []map[string]interface{}
+	if existing == nil {
+		patch = append(patch, map[string]interface{}{
+			"op":    "add",
+			"path":  "/metadata/annotations",
+			"value": annotations,
+		})
+	} else {
+		keys := make([]string, 0, len(annotations))
+		for key := range annotations {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			patch = append(patch, map[string]interface{}{
+				"op":    "add",
+				"path":  "/metadata/annotations/" + strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1"),
+				"value": annotations[key],
+			})
+		}
+	}
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	patchType := admissionv1.PatchTypeJSONPatch
+	return &admissionv1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     patchBytes,
+		PatchType: &patchType,
+	}, nil
+}
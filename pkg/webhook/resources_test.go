@@ -0,0 +1,56 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestProxyResources(t *testing.T) {
+	k8s := fake.NewSimpleClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "my-app-namespace",
+			Annotations: map[string]string{
+				"acorn.io/istio-proxy-cpu":    "500m",
+				"acorn.io/istio-proxy-memory": "lots",
+			},
+		},
+	})
+	pod, err := json.Marshal(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-app-pod",
+			Namespace: "my-app-namespace",
+			Annotations: map[string]string{
+				"sidecar.istio.io/proxyMemoryLimit": "1Gi",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := proxyResources(context.Background(), k8s, map[string]string{
+		"acorn.io/istio-proxy-cpu":          "100m",
+		"acorn.io/istio-proxy-memory":       "128Mi",
+		"acorn.io/istio-proxy-memory-limit": "256Mi",
+	}, &admissionv1.AdmissionRequest{
+		Namespace: "my-app-namespace",
+		Object:    runtime.RawExtension{Raw: pod},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The app overrides the default CPU, its invalid memory is replaced by the default, and the pod keeps its own limit
+	assert.JSONEq(t, `[
+		{"op":"add","path":"/metadata/annotations/sidecar.istio.io~1proxyCPU","value":"500m"},
+		{"op":"add","path":"/metadata/annotations/sidecar.istio.io~1proxyMemory","value":"128Mi"}
+	]`, string(resp.Patch))
+}
@@ -0,0 +1,224 @@
+package webhook
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ConfigurationName is the name of the webhook configurations that the plugin manages
+const ConfigurationName = "acorn-istio-plugin"
+
+type Options struct {
+	K8s     kubernetes.Interface
+	Address string
+	// Namespace and ServiceName identify the Service through which the API server reaches the plugin
+	Namespace   string
+	ServiceName string
+	Port        int32
+}
+
+// HandlerFunc handles an admission request. A nil response allows the request without changing it.
+type HandlerFunc func(ctx context.Context, req *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, error)
+
+// Webhook is a mutating or validating webhook served by the plugin. The ClientConfig of the webhook is filled in by
+// Serve.
+type Webhook struct {
+	Path       string
+	Handler    HandlerFunc
+	Mutating   *admissionregistrationv1.MutatingWebhook
+	Validating *admissionregistrationv1.ValidatingWebhook
+}
+
+// Serve registers the webhooks with the API server and serves them until the context is done. The webhook
+// configurations that end up without any webhook are deleted, so that the API server stops calling the plugin.
+func Serve(ctx context.Context, opts Options, webhooks ...Webhook) error {
+	var (
+		mutating   []admissionregistrationv1.MutatingWebhook
+		validating []admissionregistrationv1.ValidatingWebhook
+	)
+	if len(webhooks) > 0 {
+		caBundle, err := serveTLS(ctx, opts, webhooks)
+		if err != nil {
+			return err
+		}
+
+		for _, webhook := range webhooks {
+			path := webhook.Path
+			clientConfig := admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{
+					Namespace: opts.Namespace,
+					Name:      opts.ServiceName,
+					Path:      &path,
+					Port:      &opts.Port,
+				},
+				CABundle: caBundle,
+			}
+			if webhook.Mutating != nil {
+				m := *webhook.Mutating
+				m.ClientConfig = clientConfig
+				mutating = append(mutating, m)
+			}
+			if webhook.Validating != nil {
+				v := *webhook.Validating
+				v.ClientConfig = clientConfig
+				validating = append(validating, v)
+			}
+		}
+	}
+
+	if err := registerMutatingWebhooks(ctx, opts.K8s, mutating); err != nil {
+		return err
+	}
+	return registerValidatingWebhooks(ctx, opts.K8s, validating)
+}
+
+// Unregister deletes the webhook configurations of the plugin, so that the API server stops calling it
+func Unregister(ctx context.Context, k8s kubernetes.Interface) error {
+	if err := registerMutatingWebhooks(ctx, k8s, nil); err != nil {
+		return err
+	}
+	return registerValidatingWebhooks(ctx, k8s, nil)
+}
+
+// serveTLS serves the webhooks in the background, and returns the CA that the API server uses to verify the plugin
+func serveTLS(ctx context.Context, opts Options, webhooks []Webhook) ([]byte, error) {
+	cert, err := ensureCertificate(ctx, opts.K8s, opts.Namespace, opts.ServiceName+"-webhook-tls", opts.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	keyPair, err := tls.X509KeyPair(cert.certPEM, cert.keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	for _, webhook := range webhooks {
+		mux.Handle(webhook.Path, webhook.Handler)
+	}
+	server := &http.Server{
+		Addr:              opts.Address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig: &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{keyPair},
+		},
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	go func() {
+		if err := server.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Errorf("Failed to serve webhooks on %s: %v", opts.Address, err)
+		}
+	}()
+
+	return cert.caPEM, nil
+}
+
+func registerMutatingWebhooks(ctx context.Context, k8s kubernetes.Interface, webhooks []admissionregistrationv1.MutatingWebhook) error {
+	client := k8s.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	if len(webhooks) == 0 {
+		err := client.Delete(ctx, ConfigurationName, metav1.DeleteOptions{})
+		if err != nil && !apierror.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+
+	existing, err := client.Get(ctx, ConfigurationName, metav1.GetOptions{})
+	if apierror.IsNotFound(err) {
+		_, err = client.Create(ctx, &admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: ConfigurationName,
+			},
+			Webhooks: webhooks,
+		}, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	existing.Webhooks = webhooks
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+func registerValidatingWebhooks(ctx context.Context, k8s kubernetes.Interface, webhooks []admissionregistrationv1.ValidatingWebhook) error {
+	client := k8s.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	if len(webhooks) == 0 {
+		err := client.Delete(ctx, ConfigurationName, metav1.DeleteOptions{})
+		if err != nil && !apierror.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+
+	existing, err := client.Get(ctx, ConfigurationName, metav1.GetOptions{})
+	if apierror.IsNotFound(err) {
+		_, err = client.Create(ctx, &admissionregistrationv1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: ConfigurationName,
+			},
+			Webhooks: webhooks,
+		}, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	existing.Webhooks = webhooks
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+// ServeHTTP decodes the AdmissionReview, calls the handler, and writes back the response. Errors are returned as an
+// HTTP error rather than an AdmissionResponse, which the API server would take as a denial, so that the API server
+// applies the failure policy of the webhook.
+func (h HandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	review := admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(w, fmt.Sprintf("invalid AdmissionReview: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := h(r.Context(), review.Request)
+	if err != nil {
+		logrus.Errorf("Failed to handle admission request for %s %s/%s: %v", review.Request.Kind.Kind,
+			review.Request.Namespace, review.Request.Name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if resp == nil {
+		resp = &admissionv1.AdmissionResponse{Allowed: true}
+	}
+	resp.UID = review.Request.UID
+
+	review.Request = nil
+	review.Response = resp
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		logrus.Errorf("Failed to write admission response: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// serveReview sends an AdmissionReview with the request to the handler
+func serveReview(t *testing.T, handler HandlerFunc, req *admissionv1.AdmissionRequest) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  req,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	return recorder
+}
+
+func TestServeHTTP(t *testing.T) {
+	req := &admissionv1.AdmissionRequest{UID: "1234"}
+
+	recorder := serveReview(t, func(ctx context.Context, req *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, error) {
+		return nil, nil
+	}, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	review := admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &review); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, review.Response.Allowed)
+	assert.Equal(t, req.UID, review.Response.UID)
+
+	// Errors must not be sent as a denial, the API server applies the failure policy to HTTP errors
+	recorder = serveReview(t, func(ctx context.Context, req *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, error) {
+		return nil, errors.New("namespace not found")
+	}, req)
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "namespace not found")
+}